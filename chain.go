@@ -0,0 +1,192 @@
+package opensmtpd
+
+import (
+	"errors"
+	"io"
+)
+
+// link passes a query along the filters of a chain that have a callback for
+// it. Accepting the query calls the next filter, the first other verdict or
+// the verdict of the last filter is sent to smtpd.
+type link struct {
+	filters []*Filter
+	i       int
+	call    func(f *Filter, i int) error
+}
+
+// next calls filter i of the chain
+func (l *link) next(i int) error {
+	return l.call(l.filters[i], i)
+}
+
+// chain are the callbacks of the filters of a chain, per hook
+type chain struct {
+	connect, helo, mail, rcpt, data, eom, message []*Filter
+}
+
+// Chain returns a filter that calls the callbacks of filters, in order. A
+// query is passed to the next filter once accepted, the first filter to
+// reject it answers smtpd, so does the last filter. The event callbacks of
+// all filters are called, until one fails.
+//
+// Only one of the filters may have a DataLine or Body callback. Message
+// callbacks of several filters see the same message, with the modifications
+// of the filters before them; EOM callbacks of other filters are called in
+// their place.
+//
+// Each filter is handed its own view of the Session, sharing its state: a
+// response only counts for the filter the chain waits for, a filter that
+// responds again gets ErrDoubleResponse.
+//
+// The callbacks of each filter run through the middleware of the filter,
+// all other settings are those of the returned filter.
+func Chain(filters ...*Filter) (*Filter, error) {
+	var (
+		c       = new(chain)
+		chained = new(Filter)
+
+		// body is the filter with a DataLine or Body callback
+		body       *Filter
+		hasMessage bool
+	)
+	for _, f := range filters {
+		if f.DataLine != nil || f.Body != nil {
+			if body != nil || hasMessage {
+				return nil, errors.New("filter: only one filter of a chain may filter the message body")
+			}
+			body = f
+		}
+		if f.Message != nil {
+			if body != nil {
+				return nil, errors.New("filter: only one filter of a chain may filter the message body")
+			}
+			hasMessage = true
+		}
+
+		if f.Connect != nil {
+			c.connect = append(c.connect, f)
+		}
+		if f.HELO != nil {
+			c.helo = append(c.helo, f)
+		}
+		if f.MAIL != nil {
+			c.mail = append(c.mail, f)
+		}
+		if f.RCPT != nil {
+			c.rcpt = append(c.rcpt, f)
+		}
+		if f.DATA != nil {
+			c.data = append(c.data, f)
+		}
+		if f.EOM != nil {
+			c.eom = append(c.eom, f)
+		}
+		if f.Message != nil || f.EOM != nil {
+			c.message = append(c.message, f)
+		}
+		chained.Flags |= f.Flags
+	}
+
+	if body != nil && body.DataLine != nil {
+		name := queryName(queryDataLine)
+		chained.DataLine = func(s *Session, line string) error {
+			return body.call(s, name, func() error { return body.DataLine(s, line) })
+		}
+	} else if body != nil {
+		name := queryName(queryDataLine)
+		chained.Body = func(s *Session, r io.Reader, w io.Writer) error {
+			return body.call(s, name, func() error { return body.Body(s, r, w) })
+		}
+	}
+
+	if len(c.connect) > 0 {
+		chained.Connect = func(s *Session, query *ConnectQuery) error {
+			return chainQuery(s, c.connect, queryConnect, func(f *Filter, s *Session) error { return f.Connect(s, query) })
+		}
+	}
+	if len(c.helo) > 0 {
+		chained.HELO = func(s *Session, line string) error {
+			return chainQuery(s, c.helo, queryHELO, func(f *Filter, s *Session) error { return f.HELO(s, line) })
+		}
+	}
+	if len(c.mail) > 0 {
+		chained.MAIL = func(s *Session, user, domain string) error {
+			return chainQuery(s, c.mail, queryMAIL, func(f *Filter, s *Session) error { return f.MAIL(s, user, domain) })
+		}
+	}
+	if len(c.rcpt) > 0 {
+		chained.RCPT = func(s *Session, user, domain string) error {
+			return chainQuery(s, c.rcpt, queryRCPT, func(f *Filter, s *Session) error { return f.RCPT(s, user, domain) })
+		}
+	}
+	if len(c.data) > 0 {
+		chained.DATA = func(s *Session) error {
+			return chainQuery(s, c.data, queryDATA, func(f *Filter, s *Session) error { return f.DATA(s) })
+		}
+	}
+	if len(c.eom) > 0 {
+		chained.EOM = func(s *Session, datalen uint32) error {
+			return chainQuery(s, c.eom, queryEOM, func(f *Filter, s *Session) error { return f.EOM(s, datalen) })
+		}
+	}
+	if hasMessage {
+		chained.Message = func(s *Session, m *Message) error {
+			return chainQuery(s, c.message, queryEOM, func(f *Filter, s *Session) error {
+				if f.Message == nil {
+					return f.EOM(s, s.Transaction.DataLen)
+				}
+				return f.Message(s, m)
+			})
+		}
+	}
+
+	chained.Connected = chainEvent(filters, eventConnect, func(f *Filter) func(*Session) error { return f.Connected })
+	chained.Reset = chainEvent(filters, eventReset, func(f *Filter) func(*Session) error { return f.Reset })
+	chained.Disconnect = chainEvent(filters, eventDisconnect, func(f *Filter) func(*Session) error { return f.Disconnect })
+	chained.Begin = chainEvent(filters, eventTXBegin, func(f *Filter) func(*Session) error { return f.Begin })
+	chained.Commit = chainEvent(filters, eventTXCommit, func(f *Filter) func(*Session) error { return f.Commit })
+	chained.Rollback = chainEvent(filters, eventTXRollback, func(f *Filter) func(*Session) error { return f.Rollback })
+
+	return chained, nil
+}
+
+// chainQuery passes a query along filters, starting with the first. Each
+// filter is handed its own view of the session, the responses of which only
+// count while the chain waits for that filter.
+func chainQuery(s *Session, filters []*Filter, t int, call func(f *Filter, s *Session) error) error {
+	name := queryName(t)
+	l := &link{filters: filters}
+	l.call = func(f *Filter, i int) error {
+		v := s.view(l, i)
+		return f.call(v, name, func() error { return call(f, v) })
+	}
+	s.mu.Lock()
+	s.link = l
+	s.mu.Unlock()
+	return l.next(0)
+}
+
+// chainEvent returns a callback calling the callbacks of filters for an
+// event, nil if none of them has one.
+func chainEvent(filters []*Filter, t int, callback func(f *Filter) func(*Session) error) func(*Session) error {
+	var chained []*Filter
+	for _, f := range filters {
+		if callback(f) != nil {
+			chained = append(chained, f)
+		}
+	}
+	if len(chained) == 0 {
+		return nil
+	}
+
+	name := eventName(t)
+	return func(s *Session) error {
+		for _, f := range chained {
+			cb := callback(f)
+			if err := f.call(s, name, func() error { return cb(s) }); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,253 @@
+package opensmtpd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return func(s *Session, query string, next func() error) error {
+			calls = append(calls, name+":"+query)
+			return next()
+		}
+	}
+
+	rbl := &Filter{
+		Connected: func(s *Session) error {
+			calls = append(calls, "rbl:connected")
+			return nil
+		},
+		MAIL: func(s *Session, user, domain string) error {
+			return s.Accept()
+		},
+	}
+	rbl.Use(record("rbl"))
+	sender := &Filter{
+		MAIL: func(s *Session, user, domain string) error {
+			if domain == "example.org" {
+				return s.Permfail(EnhancedBadSender, "Sender rejected")
+			}
+			return s.Accept()
+		},
+		RCPT: func(s *Session, user, domain string) error {
+			// Answered later, the next filter waits
+			go s.AcceptCode(250, "2.1.5 Ok")
+			return nil
+		},
+	}
+	last := &Filter{
+		Connected: func(s *Session) error {
+			calls = append(calls, "last:connected")
+			return nil
+		},
+		MAIL: func(s *Session, user, domain string) error {
+			calls = append(calls, "last:MAIL")
+			return s.Accept()
+		},
+		RCPT: func(s *Session, user, domain string) error {
+			return s.AcceptCode(250, "2.1.5 Recipient ok")
+		},
+	}
+
+	f, err := Chain(rbl, sender, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Use(record("chain"))
+	ts := newTestSession(t, f)
+
+	query := func(qid uint64, qtype int, domain string) filterResponse {
+		t.Helper()
+		m := ts.query(1, qid, qtype)
+		m.PutTypeMailaddr("joe", domain)
+		return ts.roundTrip(m)
+	}
+
+	ts.event(1, eventConnect)
+
+	// Rejected by the second filter, the last is not called
+	if r := query(2, queryMAIL, "example.org"); r.QID != 2 || r.Status != FilterFail || r.Code != 550 {
+		t.Fatalf("expected rejection, got %+v", r)
+	}
+	want := "chain:EVENT_CONNECT,rbl:EVENT_CONNECT,rbl:connected,last:connected,chain:QUERY_MAIL,rbl:QUERY_MAIL"
+	if got := strings.Join(calls, ","); got != want {
+		t.Fatalf("expected calls %s, got %s", want, got)
+	}
+
+	calls = nil
+	if r := query(3, queryMAIL, "example.com"); r.QID != 3 || r.Status != FilterOK {
+		t.Fatalf("expected acceptance, got %+v", r)
+	}
+	if want := "chain:QUERY_MAIL,rbl:QUERY_MAIL,last:MAIL"; strings.Join(calls, ",") != want {
+		t.Fatalf("expected calls %s, got %s", want, strings.Join(calls, ","))
+	}
+
+	// The verdict of the last filter is sent
+	if r := query(4, queryRCPT, "example.com"); r.QID != 4 || r.Status != FilterOK || r.Line != "2.1.5 Recipient ok" {
+		t.Fatalf("expected acceptance by the last filter, got %+v", r)
+	}
+}
+
+func TestChainBody(t *testing.T) {
+	dataLine := func(s *Session, line string) error { return s.WriteLine(line) }
+	message := func(s *Session, m *Message) error { return s.Accept() }
+
+	for _, test := range []struct {
+		filters []*Filter
+		valid   bool
+	}{
+		{[]*Filter{{DataLine: dataLine}, {MAIL: func(*Session, string, string) error { return nil }}}, true},
+		{[]*Filter{{Message: message}, {Message: message}}, true},
+		{[]*Filter{{DataLine: dataLine}, {DataLine: dataLine}}, false},
+		{[]*Filter{{Message: message}, {DataLine: dataLine}}, false},
+	} {
+		if _, err := Chain(test.filters...); (err == nil) != test.valid {
+			t.Errorf("expected valid=%t, got %v", test.valid, err)
+		}
+	}
+}
+
+func TestChainMessage(t *testing.T) {
+	f, err := Chain(
+		&Filter{
+			Message: func(s *Session, m *Message) error {
+				m.Header.Prepend("X-First", "yes")
+				return s.Accept()
+			},
+		},
+		&Filter{
+			EOM: func(s *Session, datalen uint32) error {
+				return s.Accept()
+			},
+		},
+		&Filter{
+			Message: func(s *Session, m *Message) error {
+				if m.Header.Get("X-First") != "yes" {
+					t.Error("modification of the first filter missing")
+				}
+				m.Header.Prepend("X-Last", "yes")
+				return s.Accept()
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filtered, response := testFilterPipe(t, f, "Subject: test\n\nhello\n")
+	if want := "X-Last: yes\nX-First: yes\nSubject: test\n\nhello\n"; filtered != want {
+		t.Fatalf("expected body %q, got %q", want, filtered)
+	}
+	if response.Status != FilterOK || response.DataLen != uint32(len(filtered)) {
+		t.Fatalf("expected %s with datalen %d, got %+v", responseName(FilterOK), len(filtered), response)
+	}
+}
+
+func TestChainPanic(t *testing.T) {
+	f, err := Chain(
+		&Filter{
+			MAIL: func(s *Session, user, domain string) error {
+				// The next filter runs on this goroutine
+				go s.Accept()
+				return nil
+			},
+			RCPT: func(s *Session, user, domain string) error {
+				return s.Accept()
+			},
+		},
+		&Filter{
+			MAIL: func(s *Session, user, domain string) error {
+				panic("mail")
+			},
+			RCPT: func(s *Session, user, domain string) error {
+				return errors.New("lookup failed")
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported []string
+	f.ErrorPolicy = PolicyFailClosed
+	f.Error = func(s *Session, name string, err error) {
+		reported = append(reported, name)
+	}
+	ts := newTestSession(t, f)
+
+	for qid, qtype := range []int{queryMAIL, queryRCPT} {
+		m := ts.query(1, uint64(qid), qtype)
+		m.PutTypeMailaddr("joe", "example.org")
+		if r := ts.roundTrip(m); r.Status != FilterFail || r.Code != 451 {
+			t.Fatalf("%s: expected %+v, got %+v", queryName(qtype), VerdictTempfail, r)
+		}
+	}
+
+	// Failures are reported once, where they happened
+	if want := queryName(queryMAIL) + "," + queryName(queryRCPT); strings.Join(reported, ",") != want {
+		t.Fatalf("expected failures %s, got %s", want, strings.Join(reported, ","))
+	}
+}
+
+func TestChainDoubleResponse(t *testing.T) {
+	var (
+		double error
+		lookup *Session
+		called bool
+	)
+	f, err := Chain(
+		&Filter{
+			HELO: func(s *Session, helo string) error {
+				if err := s.Accept(); err != nil {
+					return err
+				}
+				double = s.Accept()
+				return nil
+			},
+		},
+		&Filter{
+			HELO: func(s *Session, helo string) error {
+				// Answered once the lookup completes
+				lookup = s
+				return nil
+			},
+		},
+		&Filter{
+			HELO: func(s *Session, helo string) error {
+				called = true
+				return s.Accept()
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestSession(t, f)
+
+	m := ts.query(1, 2, queryHELO)
+	m.PutTypeString("mx.example.org")
+	ts.handle(m)
+
+	// The second response of the first filter does not answer for the
+	// second one
+	if double != ErrDoubleResponse {
+		t.Fatalf("expected %v, got %v", ErrDoubleResponse, double)
+	}
+	if called {
+		t.Fatal("last filter called before the second one responded")
+	}
+
+	if err := lookup.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	var r filterResponse
+	ts.reply(&r)
+	if !called || r.QID != 2 || r.Status != FilterOK {
+		t.Fatalf("expected acceptance by the last filter, got %+v", r)
+	}
+	if err := lookup.Accept(); err != ErrDoubleResponse {
+		t.Fatalf("expected %v, got %v", ErrDoubleResponse, err)
+	}
+}
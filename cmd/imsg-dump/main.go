@@ -0,0 +1,226 @@
+// Command imsg-dump pretty-prints imsg frames exchanged between smtpd and a
+// filter or table proc.
+//
+// Usage:
+//
+//	imsg-dump [-api filter|table] [file]
+//
+// The input, read from stdin if no file is given, is either a capture as
+// recorded by setting opensmtpd.Capture, a stream of raw frames, or the same
+// stream as hex digits (whitespace is ignored). For each frame the header is
+// printed, with the name of the message type for the selected API. Filter
+// messages carry typed mproc fields, which are decoded one by one; table
+// messages are untyped and are printed as hex dump.
+//
+// The queue API is not supported: the opensmtpd package does not implement
+// it, and has no names for its message types.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
+var api = flag.String("api", "filter", "API of the frames, filter or table (the queue API is not supported)")
+
+// readRecords reads a capture, or splits a raw stream into records.
+func readRecords(data []byte) ([]*imsg.Record, error) {
+	var (
+		records []*imsg.Record
+		cr      = imsg.NewCaptureReader(bytes.NewReader(data))
+	)
+	for {
+		r, err := cr.ReadRecord()
+		if err == io.EOF {
+			return records, nil
+		} else if err == imsg.ErrNotCapture {
+			break
+		} else if err != nil {
+			return records, err
+		}
+		records = append(records, r)
+	}
+
+	if isHex(data) {
+		var err error
+		if data, err = hex.DecodeString(strings.Join(strings.Fields(string(data)), "")); err != nil {
+			return nil, err
+		}
+	}
+	for len(data) > 0 {
+		if len(data) < imsg.HeaderSize {
+			return records, imsg.ErrTruncated
+		}
+		size := int(binary.LittleEndian.Uint16(data[4:]))
+		if size < imsg.HeaderSize || size > imsg.MaxSize {
+			return records, fmt.Errorf("%w %d", imsg.ErrInvalidLength, size)
+		} else if size > len(data) {
+			return records, imsg.ErrTruncated
+		}
+		records = append(records, &imsg.Record{Frame: data[:size]})
+		data = data[size:]
+	}
+	return records, nil
+}
+
+func isHex(data []byte) bool {
+	return len(bytes.Trim(data, "0123456789abcdefABCDEF \t\r\n")) == 0 &&
+		len(bytes.TrimSpace(data)) > 0
+}
+
+func typeName(t uint32) string {
+	if *api == "table" {
+		return imsg.TableTypeName(t)
+	}
+	return imsg.FilterTypeName(t)
+}
+
+func dump(w io.Writer, i int, r *imsg.Record) {
+	m, err := r.Message()
+	if err != nil {
+		fmt.Fprintf(w, "#%d: %v\n", i, err)
+		return
+	}
+
+	fmt.Fprintf(w, "#%d", i)
+	if r.Direction != 0 {
+		fmt.Fprintf(w, " %s %s", r.Time.Format(time.RFC3339Nano), r.Direction)
+	}
+	fmt.Fprintf(w, " %s len=%d flags=%#x peerid=%d pid=%d", typeName(m.Header.Type),
+		m.Header.Len, m.Header.Flags, m.Header.PeerID, m.Header.PID)
+	if r.HasFD {
+		fmt.Fprint(w, " fd")
+	}
+	fmt.Fprintln(w)
+
+	if *api == "table" {
+		if len(m.Data) > 0 {
+			fmt.Fprint(w, indent(hex.Dump(m.Data)))
+		}
+		return
+	}
+	if offset, err := dumpTyped(w, m); err != nil {
+		fmt.Fprintf(w, "\t%v\n", err)
+		if rest := m.Data[offset:]; len(rest) > 0 {
+			fmt.Fprint(w, indent(hex.Dump(rest)))
+		}
+	}
+}
+
+// dumpTyped prints the typed mproc fields of a message. On error, it returns
+// the offset of the field that could not be decoded.
+func dumpTyped(w io.Writer, m *imsg.Message) (int, error) {
+	for m.Remaining() > 0 {
+		offset := len(m.Data) - m.Remaining()
+		t, _ := m.PeekType()
+		name := imsg.TypeName(t)
+		if err := m.GetType(t); err != nil {
+			return offset, err
+		}
+
+		var (
+			v   interface{}
+			err error
+		)
+		switch t {
+		case imsg.MInt:
+			v, err = m.GetInt()
+		case imsg.MUint32:
+			v, err = m.GetUint32()
+		case imsg.MSize:
+			v, err = m.GetSize()
+		case imsg.MTime:
+			var tm time.Time
+			if tm, err = m.GetTime(); err == nil {
+				v = tm.Format(time.RFC3339)
+			}
+		case imsg.MString:
+			var s string
+			if s, err = m.GetString(); err == nil {
+				v = fmt.Sprintf("%q", s)
+			}
+		case imsg.MData, imsg.MEnvelope:
+			var b []byte
+			if b, err = m.GetData(); err == nil {
+				v = fmt.Sprintf("%d bytes %q", len(b), b)
+			}
+		case imsg.MID, imsg.MEvpID:
+			var id uint64
+			if id, err = m.GetID(); err == nil {
+				v = fmt.Sprintf("%#016x", id)
+			}
+		case imsg.MMsgID:
+			var id uint32
+			if id, err = m.GetMsgID(); err == nil {
+				v = fmt.Sprintf("%#08x", id)
+			}
+		case imsg.MSockaddr:
+			var sa imsg.Sockaddr
+			if sa, err = m.GetSockaddr(); err == nil {
+				v = fmt.Sprintf("%s %s [%s]", sa.Network(), sa, sa.Layout())
+			}
+		case imsg.MMailaddr:
+			var addr imsg.Mailaddr
+			if addr.User, addr.Domain, err = m.GetMailaddr(); err == nil {
+				v = addr
+			}
+		default:
+			return offset, errors.New("unknown field " + name)
+		}
+		if err != nil {
+			return offset, fmt.Errorf("%s: %v", name, err)
+		}
+		fmt.Fprintf(w, "\t%-10s %v\n", name, v)
+	}
+	return 0, nil
+}
+
+func indent(s string) string {
+	return "\t" + strings.Replace(strings.TrimSuffix(s, "\n"), "\n", "\n\t", -1) + "\n"
+}
+
+func main() {
+	flag.Parse()
+	if *api != "filter" && *api != "table" {
+		fmt.Fprintf(os.Stderr, "usage: %s [-api filter|table] [file]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "the queue API is not supported")
+		os.Exit(2)
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if flag.NArg() > 0 {
+		data, err = os.ReadFile(flag.Arg(0))
+	} else {
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		log.Fatalln("imsg-dump:", err)
+	}
+
+	if err = run(os.Stdout, data); err != nil {
+		log.Fatalln("imsg-dump:", err)
+	}
+}
+
+// run dumps the records read from data to w
+func run(w io.Writer, data []byte) error {
+	records, err := readRecords(data)
+	for i, r := range records {
+		dump(w, i, r)
+	}
+	return err
+}
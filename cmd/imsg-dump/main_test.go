@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// testFrame encodes a message as sent on the wire
+func testFrame(t *testing.T, m *imsg.Message) []byte {
+	t.Helper()
+	m.Header.PID = 4242
+	var b bytes.Buffer
+	if err := imsg.NewEncoder(&b).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// testFilterCapture records the start of a filter session
+func testFilterCapture(t *testing.T) []byte {
+	register := imsg.NewMessage(0)
+	register.PutTypeUint32(52)
+	register.PutTypeString("test")
+
+	registered := imsg.NewMessage(0)
+	registered.PutTypeInt(0x2)
+	registered.PutTypeInt(0)
+
+	connect := imsg.NewMessage(1)
+	connect.PutTypeID(0x2a)
+	connect.PutTypeInt(0)
+
+	helo := imsg.NewMessage(2)
+	helo.PutTypeID(0x2a)
+	helo.PutTypeID(0x2b)
+	helo.PutTypeInt(1)
+	helo.PutTypeString("mx.example.org")
+
+	response := imsg.NewMessage(4)
+	response.PutTypeID(0x2b)
+	response.PutTypeInt(1)
+	response.PutTypeInt(1)
+	response.PutTypeInt(550)
+	response.PutTypeString("5.7.1 Rejected")
+
+	pipe := imsg.NewMessage(3)
+	pipe.PutTypeID(0x2a)
+	pipe.Header.Flags |= imsg.FlagHasFD
+
+	// Not typed, dumped as hex
+	garbage := imsg.NewMessage(2)
+	garbage.PutString("not typed")
+
+	var (
+		b  bytes.Buffer
+		cw = imsg.NewCaptureWriter(&b)
+		at = time.Unix(1500000000, 0)
+	)
+	for i, r := range []struct {
+		dir imsg.Direction
+		m   *imsg.Message
+	}{
+		{imsg.In, register},
+		{imsg.Out, registered},
+		{imsg.In, connect},
+		{imsg.In, helo},
+		{imsg.Out, response},
+		{imsg.In, pipe},
+		{imsg.In, garbage},
+	} {
+		err := cw.WriteRecord(&imsg.Record{
+			Direction: r.dir,
+			Time:      at.Add(time.Duration(i) * time.Millisecond),
+			HasFD:     r.m.Header.Flags&imsg.FlagHasFD != 0,
+			Frame:     testFrame(t, r.m),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+// testTableHex is a lookup and its response as a hex stream
+func testTableHex(t *testing.T) []byte {
+	lookup := imsg.NewMessage(6)
+	lookup.PutInt(1)
+	lookup.PutSize(0)
+	lookup.PutString("root")
+
+	found := imsg.NewMessage(0)
+	found.PutInt(1)
+	found.PutString("user@example.org")
+
+	frames := append(testFrame(t, lookup), testFrame(t, found)...)
+	return []byte(hex.EncodeToString(frames) + "\n")
+}
+
+func TestDump(t *testing.T) {
+	local := time.Local
+	time.Local = time.UTC
+	defer func() { time.Local = local }()
+
+	for _, test := range []struct {
+		name, api string
+		input     func(*testing.T) []byte
+	}{
+		{"filter", "filter", testFilterCapture},
+		{"table", "table", testTableHex},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			*api = test.api
+			defer func() { *api = "filter" }()
+
+			var out bytes.Buffer
+			if err := run(&out, test.input(t)); err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", test.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, out.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), want) {
+				t.Fatalf("output differs from %s:\n%s", golden, out.Bytes())
+			}
+		})
+	}
+}
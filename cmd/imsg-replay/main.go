@@ -0,0 +1,325 @@
+// Command imsg-replay feeds an imsg capture, as recorded by setting
+// opensmtpd.Capture, to a filter or table binary and compares its responses
+// with the recorded ones.
+//
+// Usage:
+//
+//	imsg-replay [-api filter|table] [-timeout 5s] [-v] <capture> <command> [args...]
+//
+// File descriptors passed by smtpd are replaced by the write end of a pipe,
+// whatever is written to it is discarded. The PID and peer ID of responses
+// are not compared.
+//
+// Filters answer the queries of different sessions concurrently, so their
+// responses are matched with the recorded ones by the session and query they
+// answer, not by position. Other messages are matched by type, in order.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
+var (
+	api     = flag.String("api", "filter", "API of the capture, filter or table")
+	timeout = flag.Duration("timeout", 5*time.Second, "time to wait for each response")
+	verbose = flag.Bool("v", false, "print every frame")
+)
+
+func readCapture(name string) ([]*imsg.Record, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		records []*imsg.Record
+		cr      = imsg.NewCaptureReader(f)
+	)
+	for {
+		r, err := cr.ReadRecord()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+}
+
+func socketpair() (*net.UnixConn, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "imsg")
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.(*net.UnixConn), os.NewFile(uintptr(fds[1]), "imsg"), nil
+}
+
+// diff describes the differences between the recorded and the replayed
+// response, or returns the empty string if they match.
+func diff(want, got *imsg.Message) string {
+	var b bytes.Buffer
+	if want.Header.Type != got.Header.Type {
+		fmt.Fprintf(&b, "\ttype %d, expected %d\n", got.Header.Type, want.Header.Type)
+	}
+	if want.Header.Flags != got.Header.Flags {
+		fmt.Fprintf(&b, "\tflags %#x, expected %#x\n", got.Header.Flags, want.Header.Flags)
+	}
+	if !bytes.Equal(want.Data, got.Data) {
+		fmt.Fprintf(&b, "\tdata differs:\n\t- % x\n\t+ % x\n", want.Data, got.Data)
+	}
+	return b.String()
+}
+
+// key identifies a response. Filter responses are keyed by the session and
+// query they answer, other responses only by their type.
+type key struct {
+	typ     uint32
+	session uint64
+	qid     uint64
+}
+
+func (k key) String() string {
+	if k.qid == 0 {
+		return fmt.Sprintf("type %d", k.typ)
+	}
+	return fmt.Sprintf("type %d session %016x query %016x", k.typ, k.session, k.qid)
+}
+
+// response is a recorded or a received response
+type response struct {
+	record int // index of the record, -1 if received
+	key    key
+	m      *imsg.Message
+}
+
+// matcher matches the responses of the proc with the recorded ones.
+type matcher struct {
+	log      *log.Logger
+	filter   bool
+	verbose  bool
+	sessions map[uint64]uint64 // session ids by query id
+	pending  []response        // recorded, not received yet
+	early    []response        // received, not recorded yet
+	diffs    int
+}
+
+func newMatcher(l *log.Logger, filter bool) *matcher {
+	return &matcher{log: l, filter: filter, sessions: make(map[uint64]uint64)}
+}
+
+// sent notes the session of the queries sent to the proc.
+func (mt *matcher) sent(m *imsg.Message) {
+	if !mt.filter || m.Header.Type != imsg.FilterQuery {
+		return
+	}
+	probe := &imsg.Message{Data: m.Data}
+	session, err := probe.GetTypeID()
+	if err != nil {
+		return
+	}
+	if qid, err := probe.GetTypeID(); err == nil {
+		mt.sessions[qid] = session
+	}
+}
+
+func (mt *matcher) key(m *imsg.Message) key {
+	k := key{typ: m.Header.Type}
+	if mt.filter && m.Header.Type == imsg.FilterResponse {
+		if qid, err := (&imsg.Message{Data: m.Data}).GetTypeID(); err == nil {
+			k.session, k.qid = mt.sessions[qid], qid
+		}
+	}
+	return k
+}
+
+// take removes the first response with key k from rs.
+func take(rs []response, k key) (response, []response, bool) {
+	for i, r := range rs {
+		if r.key == k {
+			return r, append(rs[:i], rs[i+1:]...), true
+		}
+	}
+	return response{}, rs, false
+}
+
+// expect adds the recorded response of record i.
+func (mt *matcher) expect(i int, want *imsg.Message) {
+	k := mt.key(want)
+	if got, early, ok := take(mt.early, k); ok {
+		mt.early = early
+		mt.compare(i, want, got.m)
+		return
+	}
+	mt.pending = append(mt.pending, response{record: i, key: k, m: want})
+}
+
+// received matches a response of the proc with a recorded one.
+func (mt *matcher) received(got *imsg.Message) {
+	k := mt.key(got)
+	if want, pending, ok := take(mt.pending, k); ok {
+		mt.pending = pending
+		mt.compare(want.record, want.m, got)
+		return
+	}
+	mt.early = append(mt.early, response{record: -1, key: k, m: got})
+}
+
+func (mt *matcher) compare(i int, want, got *imsg.Message) {
+	if d := diff(want, got); d != "" {
+		mt.log.Printf("record %d: response differs\n%s", i, d)
+		mt.diffs++
+	} else if mt.verbose {
+		mt.log.Printf("record %d: recv type %d, %d bytes\n", i, got.Header.Type, len(got.Data))
+	}
+}
+
+// missing reports the pending responses, which were not received.
+func (mt *matcher) missing(err error) {
+	for _, r := range mt.pending {
+		mt.log.Printf("record %d: expected %s, got %v\n", r.record, r.key, err)
+		mt.diffs++
+	}
+	mt.pending = nil
+}
+
+// unexpected reports the responses that were not recorded.
+func (mt *matcher) unexpected() {
+	for _, r := range mt.early {
+		mt.log.Printf("unexpected response %s, %d bytes: % x\n", r.key, len(r.m.Data), r.m.Data)
+		mt.diffs++
+	}
+	mt.early = nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 2 || (*api != "filter" && *api != "table") {
+		fmt.Fprintf(os.Stderr, "usage: %s [-api filter|table] [-timeout 5s] [-v] <capture> <command> [args...]\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	records, err := readCapture(flag.Arg(0))
+	if err != nil {
+		log.Fatalln("imsg-replay:", err)
+	}
+
+	c, stdin, err := socketpair()
+	if err != nil {
+		log.Fatalln("imsg-replay:", err)
+	}
+
+	cmd := exec.Command(flag.Arg(1), flag.Args()[2:]...)
+	cmd.Stdin = stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		log.Fatalln("imsg-replay:", err)
+	}
+	stdin.Close()
+
+	var (
+		dec = imsg.NewDecoder(c)
+		enc = imsg.NewEncoder(c)
+		mt  = newMatcher(log.Default(), *api == "filter")
+	)
+	mt.verbose = *verbose
+
+	// await receives responses until all the recorded ones arrived
+	await := func() {
+		for len(mt.pending) > 0 {
+			got := new(imsg.Message)
+			c.SetReadDeadline(time.Now().Add(*timeout))
+			if err := dec.Decode(got); err != nil {
+				mt.missing(err)
+				return
+			}
+			if got.File != nil {
+				got.File.Close()
+			}
+			mt.received(got)
+		}
+	}
+
+	for i, r := range records {
+		want, err := r.Message()
+		if err != nil {
+			log.Fatalf("imsg-replay: record %d: %v\n", i, err)
+		}
+
+		switch r.Direction {
+		case imsg.In:
+			// smtpd had these responses before sending the message
+			await()
+			if *verbose {
+				log.Printf("record %d: send type %d, %d bytes\n", i, want.Header.Type, len(want.Data))
+			}
+			want.Header.Flags &^= imsg.FlagHasFD
+			if r.HasFD {
+				pr, pw, err := os.Pipe()
+				if err != nil {
+					log.Fatalln("imsg-replay:", err)
+				}
+				go func() {
+					io.Copy(io.Discard, pr)
+					pr.Close()
+				}()
+				want.File = pw
+			}
+			mt.sent(want)
+			if err = enc.Encode(want); err != nil {
+				log.Fatalf("imsg-replay: record %d: %v\n", i, err)
+			}
+
+		case imsg.Out:
+			mt.expect(i, want)
+
+		default:
+			log.Printf("record %d: skipping unknown direction %s\n", i, r.Direction)
+		}
+	}
+
+	await()
+
+	// Anything else the proc has to say was not recorded
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		got := new(imsg.Message)
+		if err = dec.Decode(got); err != nil {
+			break
+		}
+		if got.File != nil {
+			got.File.Close()
+		}
+		mt.received(got)
+	}
+	mt.unexpected()
+
+	c.Close()
+	if err = cmd.Wait(); err != nil {
+		log.Printf("imsg-replay: %s: %v\n", flag.Arg(1), err)
+	}
+
+	log.Printf("imsg-replay: %d records, %d differences\n", len(records), mt.diffs)
+	if mt.diffs > 0 {
+		os.Exit(1)
+	}
+}
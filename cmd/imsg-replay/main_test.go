@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
+// testQuery returns the IMSG_FILTER_QUERY of a HELO
+func testQuery(session, qid uint64) *imsg.Message {
+	m := imsg.NewMessage(imsg.FilterQuery)
+	m.PutTypeID(session)
+	m.PutTypeID(qid)
+	m.PutTypeInt(1)
+	m.PutTypeString("mx.example.org")
+	return m
+}
+
+// testResponse returns the IMSG_FILTER_RESPONSE to a HELO
+func testResponse(qid uint64, status int) *imsg.Message {
+	m := imsg.NewMessage(imsg.FilterResponse)
+	m.PutTypeID(qid)
+	m.PutTypeInt(1)
+	m.PutTypeInt(status)
+	m.PutTypeInt(0)
+	return m
+}
+
+func TestMatcherOrder(t *testing.T) {
+	var out bytes.Buffer
+	mt := newMatcher(log.New(&out, "", 0), true)
+
+	// Two sessions query at once, the second one is answered first
+	mt.sent(testQuery(1, 10))
+	mt.sent(testQuery(2, 20))
+	mt.expect(2, testResponse(10, 0))
+	mt.expect(3, testResponse(20, 0))
+	mt.received(testResponse(20, 0))
+	mt.received(testResponse(10, 0))
+
+	// A response arriving before the recorded one is matched later
+	mt.sent(testQuery(1, 11))
+	mt.received(testResponse(11, 0))
+	mt.expect(5, testResponse(11, 0))
+
+	mt.missing(io.EOF)
+	mt.unexpected()
+	if mt.diffs != 0 {
+		t.Fatalf("expected no differences, got %d:\n%s", mt.diffs, out.String())
+	}
+}
+
+func TestMatcherDiffs(t *testing.T) {
+	var out bytes.Buffer
+	mt := newMatcher(log.New(&out, "", 0), true)
+
+	mt.sent(testQuery(1, 10))
+	mt.sent(testQuery(2, 20))
+	mt.sent(testQuery(3, 30))
+	mt.expect(3, testResponse(10, 0))
+	mt.expect(4, testResponse(20, 0))
+	mt.received(testResponse(20, 1))
+	mt.received(testResponse(30, 0))
+	mt.missing(io.EOF)
+	mt.unexpected()
+
+	for _, want := range []string{
+		"record 4: response differs",
+		"record 3: expected type 4 session 0000000000000001 query 000000000000000a, got EOF",
+		"unexpected response type 4 session 0000000000000003 query 000000000000001e",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, out.String())
+		}
+	}
+	if mt.diffs != 3 {
+		t.Fatalf("expected 3 differences, got %d", mt.diffs)
+	}
+}
+
+func TestMatcherTable(t *testing.T) {
+	var out bytes.Buffer
+	mt := newMatcher(log.New(&out, "", 0), false)
+
+	// Table responses are untyped, and matched in order
+	ok, fail := imsg.NewMessage(imsg.TableOK), imsg.NewMessage(imsg.TableOK)
+	ok.PutInt(1)
+	fail.PutInt(0)
+	mt.expect(1, ok)
+	mt.expect(3, fail)
+	mt.received(fail)
+	mt.received(ok)
+
+	if mt.diffs != 2 || !strings.Contains(out.String(), "record 1: response differs") {
+		t.Fatalf("expected 2 differences in order, got %d:\n%s", mt.diffs, out.String())
+	}
+}
@@ -1,12 +1,111 @@
 package opensmtpd
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
 	"net"
 	"os"
+	"sync"
+
+	"gopkg.in/opensmtpd.v0/imsg"
 )
 
-// newConn wraps a file descriptor to a net.FileConn
-func newConn(fd int) (net.Conn, error) {
+// conn is the imsg transport to smtpd, always a UNIX domain socket so file
+// descriptors can be passed along.
+type conn struct {
+	*net.UnixConn
+
+	dec *imsg.Decoder
+
+	// wmu serializes writers
+	wmu sync.Mutex
+	enc *imsg.Encoder
+
+	// capture receives a copy of every frame, if set
+	capture *imsg.CaptureWriter
+
+	// logger receives frame traces, set by the owner of the connection
+	logger Logger
+}
+
+// newConn wraps a file descriptor to a net.UnixConn
+func newConn(fd int) (*conn, error) {
 	f := os.NewFile(uintptr(fd), "")
-	return net.FileConn(f)
+	defer f.Close()
+
+	fc, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	uc, ok := fc.(*net.UnixConn)
+	if !ok {
+		fc.Close()
+		return nil, fmt.Errorf("imsg: fd %d is not a UNIX domain socket", fd)
+	}
+
+	c := &conn{
+		UnixConn: uc,
+		dec:      imsg.NewDecoder(uc),
+		enc:      imsg.NewEncoder(uc),
+	}
+	if Capture != nil {
+		c.capture = imsg.NewCaptureWriter(Capture)
+	}
+	return c, nil
+}
+
+// ReadMessage reads the next message, waiting for it if no data is
+// available yet.
+func (c *conn) ReadMessage(m *imsg.Message) error {
+	for {
+		err := c.dec.Decode(m)
+		if err == imsg.ErrAgain {
+			continue
+		} else if err != nil {
+			return err
+		}
+		c.trace(imsg.In, m)
+		if c.capture != nil {
+			if err = c.capture.WriteMessage(imsg.In, m); err != nil {
+				c.captureFailed(err)
+			}
+		}
+		return nil
+	}
+}
+
+// WriteMessage sends a message, it is safe for concurrent use.
+func (c *conn) WriteMessage(m *imsg.Message) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.enc.Encode(m); err != nil {
+		return err
+	}
+	c.trace(imsg.Out, m)
+	if c.capture != nil {
+		if err := c.capture.WriteMessage(imsg.Out, m); err != nil {
+			c.captureFailed(err)
+		}
+	}
+	return nil
+}
+
+func (c *conn) trace(dir imsg.Direction, m *imsg.Message) {
+	if l := logAt(c.logger, slog.LevelDebug); l != nil {
+		l.LogAttrs(context.Background(), slog.LevelDebug, "imsg",
+			slog.String("dir", dir.String()),
+			slog.Uint64("type", uint64(m.Header.Type)),
+			slog.Int("len", m.Len()),
+			slog.Bool("fd", m.Header.Flags&imsg.FlagHasFD != 0),
+			slog.String("data", fmt.Sprintf("%q", m.Data)))
+	}
+}
+
+func (c *conn) captureFailed(err error) {
+	if l := logAt(c.logger, slog.LevelError); l != nil {
+		l.LogAttrs(context.Background(), slog.LevelError, "imsg capture failed",
+			slog.Any("error", err))
+	}
 }
@@ -0,0 +1,27 @@
+package opensmtpd
+
+import (
+	"syscall"
+	"testing"
+)
+
+// testConnPair returns both ends of a connected imsg transport
+func testConnPair(tb testing.TB) (a, b *conn) {
+	tb.Helper()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if a, err = newConn(fds[0]); err != nil {
+		tb.Fatal(err)
+	}
+	if b, err = newConn(fds[1]); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return
+}
@@ -13,7 +13,55 @@ Filters
 
 Hooks for the various SMTP transaction stages. If a filter function is
 registered for a callback, the OpenSMTPD process expects a reply via the
-Session.Accept() or Session.Reject() calls. Failing to do so may result in a
-locked up mail server, you have been warned!
+Session.Accept() or Session.Respond() calls. Failing to do so may result in a
+locked up mail server, you have been warned! Setting Filter.Timeout makes the
+filter respond with Filter.Fallback on behalf of callbacks that miss their
+deadline.
+
+Session.Tempfail(), Session.Permfail() and Session.Disconnect() reject a query
+with a reply carrying an RFC 3463 enhanced status code. Replies are validated
+before they are sent: the code has to match the status, and the text can not
+contain line breaks, smtpd sends a filter reply as a single line.
+
+Callbacks for different sessions run concurrently, up to Filter.Workers at a
+time, while the messages of one session are handled in order. A callback may
+return before responding, and call Session.Accept() or Session.Respond() later
+from another goroutine, for example once a slow DNS lookup completes.
+Session.Context() is cancelled when the query is answered, the client
+disconnects or the filter shuts down, so such lookups can be abandoned.
+Filter.ServeContext() stops serving once its context is done, after the
+queries in flight were answered.
+
+The message body can be filtered with either the DataLine or the Body
+callback. smtpd streams the body, without the final ".", through a pipe and
+reads back what the filter writes; the EOM callback is called once the body
+has been filtered, and smtpd is told the size of the new body.
+
+Filters that rather look at the message as a whole use the Message callback
+instead. It receives a parsed Message, of which the header fields and MIME
+parts can be modified before the message is accepted or rejected.
+
+Independent policies can be written as separate filters and run in one
+process with Chain(), which passes every query along the filters until one
+rejects it. Filter.Use() adds middleware, called around every callback, for
+example LogMiddleware() or TimingMiddleware() to log or time them.
+
+A callback that returns an error, or panics, stops Serve by default. With
+Filter.ErrorPolicy, or Filter.HookErrorPolicy per hook, the filter instead
+keeps serving, and answers the query of the failed callback by accepting it
+(PolicyFailOpen) or with a temporary failure (PolicyFailClosed). Failures are
+counted, see Filter.ErrorCounts(), and reported to the Error callback.
+
+Filters and tables log through the slog package by default. Setting
+Filter.Logger or Table.Logger, for example to a *slog.Logger, directs their
+messages elsewhere; traces of the exchanged messages are logged at debug
+level.
+
+
+Wire protocol
+
+The imsg subpackage implements the imsg framing and mproc encoding used on the
+wire, Filter and Table are built on top of it. It can be used to implement
+other OpenSMTPD procs, or to test them.
 */
 package opensmtpd
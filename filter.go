@@ -1,71 +1,108 @@
 package opensmtpd
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"os"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	lru "github.com/hashicorp/golang-lru"
+	"gopkg.in/opensmtpd.v0/imsg"
 )
 
 const (
-	typeFilterRegister uint32 = iota
-	typeFilterEvent
-	typeFilterquery
-	typeFilterPipe
-	typeFilterResponse
+	typeFilterRegister = imsg.FilterRegister
+	typeFilterEvent    = imsg.FilterEvent
+	typeFilterquery    = imsg.FilterQuery
+	typeFilterPipe     = imsg.FilterPipe
+	typeFilterResponse = imsg.FilterResponse
 )
 
-var filterTypeName = map[uint32]string{
-	typeFilterRegister: "IMSG_FILTER_REGISTER",
-	typeFilterEvent:    "IMSG_FILTER_EVENT",
-	typeFilterquery:    "IMSG_FILTER_QUERY",
-	typeFilterPipe:     "IMSG_FILTER_PIPE",
-	typeFilterResponse: "IMSG_FILTER_RESPONSE",
+func filterName(t uint32) string {
+	return imsg.FilterTypeName(t)
 }
 
-func filterName(t uint32) string {
-	if s, ok := filterTypeName[t]; ok {
-		return s
+// Hook is a set of filter hooks, smtpd only sends the queries and events a
+// filter registered hooks for.
+type Hook int
+
+// Hooks
+const (
+	HookConnect Hook = 1 << iota
+	HookHELO
+	HookMAIL
+	HookRCPT
+	HookDATA
+	HookEOM
+	HookReset
+	HookDisconnect
+	HookCommit
+	HookRollback
+	HookDataLine
+)
+
+var hookTypeName = map[Hook]string{
+	HookConnect:    "HOOK_CONNECT",
+	HookHELO:       "HOOK_HELO",
+	HookMAIL:       "HOOK_MAIL",
+	HookRCPT:       "HOOK_RCPT",
+	HookDATA:       "HOOK_DATA",
+	HookEOM:        "HOOK_EOM",
+	HookReset:      "HOOK_RESET",
+	HookDisconnect: "HOOK_DISCONNECT",
+	HookCommit:     "HOOK_COMMIT",
+	HookRollback:   "HOOK_ROLLBACK",
+	HookDataLine:   "HOOK_DATALINE",
+}
+
+func (h Hook) String() string {
+	var s []string
+	for i := Hook(1); i <= HookDataLine; i <<= 1 {
+		if h&i != 0 {
+			s = append(s, hookTypeName[i])
+		}
 	}
-	return fmt.Sprintf("UNKNOWN %d", t)
+	return strings.Join(s, ",")
 }
 
+// Flag is a set of filter registration flags, the values follow FILTER_* in
+// smtpd.h.
+type Flag int
+
+// Flags
 const (
-	hookConnect = 1 << iota
-	hookHELO
-	hookMAIL
-	hookRCPT
-	hookDATA
-	hookEOM
-	hookReset
-	hookDisconnect
-	hookCommit
-	hookRollback
-	hookDataLine
+	// FlagAlterData tells smtpd the filter may modify the message body. It
+	// requires the data pipe: a DataLine, Body or Message callback.
+	FlagAlterData Flag = 1 << iota
+
+	// FlagEvents asks smtpd to send all session and transaction events,
+	// also for events the filter has no hook for. It requires at least one
+	// event callback.
+	FlagEvents
 )
 
-var hookTypeName = map[uint16]string{
-	hookConnect:    "HOOK_CONNECT",
-	hookHELO:       "HOOK_HELO",
-	hookMAIL:       "HOOK_MAIL",
-	hookRCPT:       "HOOK_RCPT",
-	hookDATA:       "HOOK_DATA",
-	hookEOM:        "HOOK_EOM",
-	hookReset:      "HOOK_RESET",
-	hookDisconnect: "HOOK_DISCONNECT",
-	hookCommit:     "HOOK_COMMIT",
-	hookRollback:   "HOOK_ROLLBACK",
-	hookDataLine:   "HOOK_DATALINE",
-}
-
-func hookName(h uint16) string {
+var flagTypeName = map[Flag]string{
+	FlagAlterData: "FILTER_ALTERDATA",
+	FlagEvents:    "FILTER_EVENTS",
+}
+
+func (fl Flag) String() string {
 	var s []string
-	for i := uint(0); i < 11; i++ {
-		if h&(1<<i) != 0 {
-			s = append(s, hookTypeName[(1<<i)])
+	for i := Flag(1); i <= fl && i != 0; i <<= 1 {
+		if fl&i == 0 {
+			continue
+		}
+		if name, ok := flagTypeName[i]; ok {
+			s = append(s, name)
+		} else {
+			s = append(s, fmt.Sprintf("UNKNOWN %#x", int(i)))
 		}
 	}
 	return strings.Join(s, ",")
@@ -116,6 +153,17 @@ var queryTypeName = map[int]string{
 	queryDataLine: "QUERY_DATALINE",
 }
 
+// queryHook is the hook a query is sent for
+var queryHook = map[int]Hook{
+	queryConnect:  HookConnect,
+	queryHELO:     HookHELO,
+	queryMAIL:     HookMAIL,
+	queryRCPT:     HookRCPT,
+	queryDATA:     HookDATA,
+	queryEOM:      HookEOM,
+	queryDataLine: HookDataLine,
+}
+
 func queryName(t int) string {
 	if s, ok := queryTypeName[t]; ok {
 		return s
@@ -159,103 +207,293 @@ type Filter struct {
 	// DATA callback
 	DATA func(*Session) error
 
-	// DataLine callback
+	// DataLine callback, called for every line of the message body, without
+	// the line terminator. Lines are only passed on to smtpd if written
+	// back with Session.WriteLine. DataLine is called from its own
+	// goroutine, while the message is received.
 	DataLine func(*Session, string) error
 
-	// EOM (end of message) callback
+	// Body callback, called with the message body as it is received, the
+	// body passed on to smtpd is what the callback writes to w. Like
+	// DataLine it runs in its own goroutine, the two are mutually
+	// exclusive.
+	Body func(s *Session, r io.Reader, w io.Writer) error
+
+	// Message callback, called at the end of the message instead of EOM,
+	// with the parsed message. Changes to the message are passed on to
+	// smtpd when the message is accepted or rejected; if the query expires
+	// first, smtpd gets the message as received.
+	Message func(*Session, *Message) error
+
+	// EOM (end of message) callback, with the size of the message. The
+	// message can still be accepted or rejected at this stage.
 	EOM func(*Session, uint32) error
 
-	// Reset callback
+	// The event callbacks below are notifications, smtpd expects no
+	// response to them.
+
+	// Connected callback, called when a session is created, before the
+	// Connect query
+	Connected func(*Session) error
+
+	// Reset callback, called on RSET
 	Reset func(*Session) error
 
-	// Disconnect callback
+	// Disconnect callback, called when the session ends
 	Disconnect func(*Session) error
 
-	// Commit callback
+	// Begin callback, called when a transaction (MAIL FROM) starts
+	Begin func(*Session) error
+
+	// Commit callback, called when the message of the transaction was
+	// queued
 	Commit func(*Session) error
 
+	// Rollback callback, called when the transaction was aborted
+	Rollback func(*Session) error
+
+	// Flags are sent to smtpd at registration
+	Flags Flag
+
 	Name    string
 	Version uint32
 
-	c net.Conn
-	m *message
+	// Timeout is the time a callback has to respond to a query, after
+	// which the filter responds with Fallback on its behalf. Zero means no
+	// deadline.
+	Timeout time.Duration
+
+	// HookTimeout overrides Timeout for individual hooks
+	HookTimeout map[Hook]time.Duration
+
+	// Fallback is the response to queries not answered before their
+	// deadline, the zero value accepts.
+	Fallback Verdict
+
+	// MaxSessions is the maximum number of sessions tracked, zero for no
+	// limit. Sessions beyond the limit are refused: their queries are
+	// answered with VerdictTempfail, without calling the callbacks.
+	MaxSessions int
+
+	// SessionTimeout is the time after which a session without any
+	// activity is considered leaked, because smtpd never reported its
+	// disconnection. Leaked sessions are logged and dropped. Zero disables
+	// leak detection.
+	SessionTimeout time.Duration
+
+	// Workers is the maximum number of messages handled concurrently,
+	// DefaultWorkers if zero. The messages of a session are always handled
+	// in order, one at a time.
+	Workers int
+
+	// ErrorPolicy decides what happens when a callback returns an error
+	// or panics, PolicyStop if zero. HookErrorPolicy overrides it for
+	// individual hooks.
+	ErrorPolicy     Policy
+	HookErrorPolicy map[Hook]Policy
+
+	// Error callback, called for every failed callback with its query or
+	// event name; panics are reported as *PanicError.
+	Error func(s *Session, name string, err error)
+
+	// Logger receives the log messages of the filter, the default logger
+	// of the slog package if nil.
+	Logger Logger
+
+	// middleware wraps the callbacks, see Use
+	middleware []Middleware
+
+	c *conn
+	m *imsg.Message
+
+	// ctx is the context of ServeContext, those of the sessions derive
+	// from it
+	ctx context.Context
+
+	hooks Hook
+	ready bool
+
+	// mu protects the session table, and queues, the pending messages of
+	// busy sessions
+	mu       sync.Mutex
+	sessions map[uint64]*Session
+	queues   map[uint64]*sessionQueue
+	workers  chan struct{}
+	wg       sync.WaitGroup
+
+	// err is the first error of a callback, it stops Serve
+	errOnce sync.Once
+	err     error
+
+	// errCounts counts failed callbacks by name, protected by mu
+	errCounts map[string]uint64
+}
+
+// filterVersions are the filter API versions we speak, in ascending order.
+// Versions 51 and 52 use the same message layouts and hooks; a version
+// changing them has to be told apart where the layouts are used.
+var filterVersions = []uint32{51, 52}
+
+// knownFlags are the flags smtpd understands
+const knownFlags = FlagAlterData | FlagEvents
+
+// FilterVersions returns the supported filter API versions, in ascending
+// order
+func FilterVersions() []uint32 {
+	return append([]uint32(nil), filterVersions...)
+}
+
+// UnsupportedVersionError is returned by Register if smtpd speaks a filter
+// API version we do not support
+type UnsupportedVersionError struct {
+	Version uint32
+}
+
+func (err UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("filter: unsupported filter API version %d, supported are %v", err.Version, FilterVersions())
+}
 
-	hooks   int
-	flags   int
-	ready   bool
-	session *lru.Cache
+// checkFlags validates the flags against the registered hooks
+func (f *Filter) checkFlags() error {
+	if f.Flags&FlagAlterData != 0 && f.hooks&HookDataLine == 0 {
+		return fmt.Errorf("filter: flag %s requires the data pipe (a DataLine, Body or Message callback)", FlagAlterData)
+	}
+	if f.Flags&FlagEvents != 0 && f.Connected == nil && f.Reset == nil && f.Disconnect == nil &&
+		f.Begin == nil && f.Commit == nil && f.Rollback == nil {
+		return fmt.Errorf("filter: flag %s without event callbacks", FlagEvents)
+	}
+	return nil
+}
+
+// Verdict is a response to a query
+type Verdict struct {
+	// Status is FilterOK, FilterFail or FilterClose
+	Status int
+
+	// Code is the SMTP reply code, zero for the default of smtpd
+	Code int
+
+	// Line is the SMTP reply text, empty for the default of smtpd
+	Line string
+}
+
+// Common verdicts, for use as Filter.Fallback
+var (
+	VerdictAccept   = Verdict{Status: FilterOK}
+	VerdictTempfail = Verdict{Status: FilterFail, Code: 451, Line: "Temporary failure, try again later"}
+	VerdictClose    = Verdict{Status: FilterClose, Code: 421, Line: "Service not available, closing transmission channel"}
+)
+
+// ErrDoubleResponse is returned when a query is responded to twice
+var ErrDoubleResponse = errors.New("filter: query already responded to")
+
+// DefaultWorkers is the default number of concurrent workers of a Filter
+const DefaultWorkers = 64
+
+// sessionQueue holds the messages of a session, handled in order
+type sessionQueue struct {
+	messages []*imsg.Message
+	running  bool
 }
 
 // Register our filter with OpenSMTPD
 func (f *Filter) Register() error {
 	var err error
 	if f.m == nil {
-		f.m = new(message)
+		f.m = new(imsg.Message)
 	}
 	if f.c == nil {
 		if f.c, err = newConn(0); err != nil {
 			return err
 		}
 	}
-	if err = f.m.ReadFrom(f.c); err != nil {
+	f.c.logger = f.Logger
+	if err = f.c.ReadMessage(f.m); err != nil {
 		return err
 	}
 
 	// Fill hooks mask
 	if f.Connect != nil {
-		f.hooks |= hookConnect
+		f.hooks |= HookConnect
 	}
 	if f.HELO != nil {
-		f.hooks |= hookHELO
+		f.hooks |= HookHELO
 	}
 	if f.MAIL != nil {
-		f.hooks |= hookMAIL
+		f.hooks |= HookMAIL
 	}
 	if f.RCPT != nil {
-		f.hooks |= hookRCPT
+		f.hooks |= HookRCPT
 	}
 	if f.DATA != nil {
-		f.hooks |= hookDATA
+		f.hooks |= HookDATA
+	}
+	var bodyHooks int
+	for _, hooked := range []bool{f.DataLine != nil, f.Body != nil, f.Message != nil} {
+		if hooked {
+			bodyHooks++
+		}
+	}
+	if bodyHooks > 1 {
+		return errors.New("filter: DataLine, Body and Message callbacks are mutually exclusive")
+	} else if bodyHooks == 1 {
+		f.hooks |= HookDataLine
 	}
-	if f.DataLine != nil {
-		f.hooks |= hookDataLine
+	if f.EOM != nil || f.Message != nil {
+		f.hooks |= HookEOM
 	}
-	if f.EOM != nil {
-		f.hooks |= hookEOM
+	if f.Reset != nil {
+		f.hooks |= HookReset
 	}
 	if f.Disconnect != nil {
-		f.hooks |= hookDisconnect
+		f.hooks |= HookDisconnect
 	}
 	if f.Commit != nil {
-		f.hooks |= hookCommit
+		f.hooks |= HookCommit
 	}
-
-	if t, ok := filterTypeName[f.m.Header.Type]; ok {
-		log.Printf("filter: imsg %s\n", t)
-	} else {
-		log.Printf("filter: imsg UNKNOWN %d\n", f.m.Header.Type)
+	if f.Rollback != nil {
+		f.hooks |= HookRollback
 	}
 
 	switch f.m.Header.Type {
 	case typeFilterRegister:
-		var err error
-		if f.Version, err = f.m.GetTypeUint32(); err != nil {
+		var query registerQuery
+		if err = imsg.Unmarshal(f.m, &query); err != nil {
 			return err
 		}
-		if f.Name, err = f.m.GetTypeString(); err != nil {
+		f.Version, f.Name = query.Version, query.Name
+		if l := logAt(f.Logger, slog.LevelInfo); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelInfo, "filter registered",
+				slog.String("name", f.Name),
+				slog.Uint64("version", uint64(f.Version)))
+		}
+
+		if !slices.Contains(filterVersions, f.Version) {
+			return UnsupportedVersionError{f.Version}
+		}
+		if unknown := f.Flags &^ knownFlags; unknown != 0 {
+			return fmt.Errorf("filter: unknown flags %s", unknown)
+		}
+		if err = f.checkFlags(); err != nil {
 			return err
 		}
-		log.Printf("register version=%d,name=%q\n", f.Version, f.Name)
+		if err = f.Fallback.Validate(); err != nil {
+			return fmt.Errorf("filter: fallback: %w", err)
+		}
 
-		f.m.reset()
+		f.m.Reset()
 		f.m.Header.Type = typeFilterRegister
-		f.m.PutTypeInt(f.hooks)
-		f.m.PutTypeInt(f.flags)
-		if err = f.m.WriteTo(f.c); err != nil {
+		if err = imsg.Marshal(f.m, &registerResponse{
+			Hooks: f.hooks,
+			Flags: f.Flags,
+		}); err != nil {
+			return err
+		}
+		if err = f.c.WriteMessage(f.m); err != nil {
 			return err
 		}
 	default:
-		return fmt.Errorf("filter: unexpected imsg type=%s\n", filterTypeName[f.m.Header.Type])
+		return fmt.Errorf("filter: unexpected imsg type=%s\n", filterName(f.m.Header.Type))
 	}
 
 	f.ready = true
@@ -265,55 +503,194 @@ func (f *Filter) Register() error {
 // Serve communicates with OpenSMTPD in a loop, until either one of the
 // parties closes stdin.
 func (f *Filter) Serve() error {
+	return f.ServeContext(context.Background())
+}
+
+// ServeContext is like Serve, it also stops once ctx is done. It then stops
+// reading from smtpd, waits for the callbacks handling the messages received
+// so far, answers the queries left unanswered with Fallback and returns
+// ctx.Err().
+//
+// The contexts of the sessions, see Session.Context, are cancelled once ctx
+// is done or ServeContext returns.
+func (f *Filter) ServeContext(ctx context.Context) error {
 	var err error
 
-	if !f.ready {
-		if err = f.Register(); err != nil {
+	if f.m == nil {
+		f.m = new(imsg.Message)
+	}
+	if f.c == nil {
+		if f.c, err = newConn(0); err != nil {
 			return err
 		}
 	}
 
-	if f.m == nil {
-		f.m = new(message)
-	}
-	if f.session == nil {
-		if f.session, err = lru.New(1024); err != nil {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	f.ctx = ctx
+
+	// Interrupt the pending read on shutdown
+	stop := context.AfterFunc(parent, func() { f.c.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	if !f.ready {
+		if err = f.Register(); err != nil {
+			if parent.Err() != nil {
+				return parent.Err()
+			}
 			return err
 		}
 	}
-	if f.c == nil {
-		if f.c, err = newConn(0); err != nil {
-			return err
+
+	if f.workers == nil {
+		workers := f.Workers
+		if workers <= 0 {
+			workers = DefaultWorkers
 		}
+		f.workers = make(chan struct{}, workers)
+		f.queues = make(map[uint64]*sessionQueue)
+	}
+
+	if f.SessionTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go f.sweep(stop)
 	}
 
 	for {
-		if err := f.m.ReadFrom(f.c); err != nil {
-			if err.Error() != "resource temporarily unavailable" {
-				return err
+		m := imsg.AcquireMessage(0)
+		if err = f.c.ReadMessage(m); err == nil {
+			err = f.dispatch(m)
+		} else {
+			imsg.ReleaseMessage(m)
+		}
+		if err == nil {
+			continue
+		}
+
+		if parent.Err() != nil {
+			// Shutdown, smtpd still waits for our responses
+			f.wg.Wait()
+			f.drain()
+			if f.err != nil {
+				return f.err
 			}
+			return parent.Err()
 		}
-		if err := f.handle(); err != nil {
-			return err
+
+		// smtpd is gone, or a callback failed and closed the
+		// connection: the running callbacks are cancelled
+		cancel()
+		f.wg.Wait()
+		if f.err != nil {
+			return f.err
+		} else if err == io.EOF {
+			return nil
 		}
+		return err
 	}
 }
 
-func (f *Filter) handle() (err error) {
-	if t, ok := filterTypeName[f.m.Header.Type]; ok {
-		log.Printf("filter: imsg %s\n", t)
-	} else {
-		log.Printf("filter: imsg UNKNOWN %d\n", f.m.Header.Type)
+// drain answers the queries still pending at shutdown with Fallback
+func (f *Filter) drain() {
+	for _, s := range f.Sessions() {
+		s.mu.Lock()
+		qid, pending := s.qid, s.qctx != nil
+		s.mu.Unlock()
+		if pending {
+			f.expire(s, qid, "filter query not answered at shutdown")
+		}
 	}
+}
 
-	switch f.m.Header.Type {
+// dispatch queues a message for its session. Every filter message starts
+// with the session ID. A disconnect cancels the contexts of the session right
+// away, the callbacks still busy with it do not wait for the event to be
+// handled in turn.
+func (f *Filter) dispatch(m *imsg.Message) error {
+	peek := *m
+	id, err := peek.GetTypeID()
+	if err != nil {
+		imsg.ReleaseMessage(m)
+		return fmt.Errorf("filter: %s without session: %v", filterName(m.Header.Type), err)
+	}
+
+	f.mu.Lock()
+	if m.Header.Type == typeFilterEvent {
+		if t, err := peek.GetTypeInt(); err == nil && t == eventDisconnect {
+			if s, ok := f.sessions[id]; ok {
+				s.end()
+			}
+		}
+	}
+	q := f.queues[id]
+	if q == nil {
+		q = new(sessionQueue)
+		f.queues[id] = q
+	}
+	q.messages = append(q.messages, m)
+	start := !q.running
+	q.running = true
+	f.mu.Unlock()
+
+	if start {
+		f.wg.Add(1)
+		go f.run(id, q)
+	}
+	return nil
+}
+
+// run handles the queued messages of a session, until there are none left.
+func (f *Filter) run(id uint64, q *sessionQueue) {
+	defer f.wg.Done()
+
+	for {
+		f.mu.Lock()
+		if len(q.messages) == 0 {
+			q.running = false
+			delete(f.queues, id)
+			f.mu.Unlock()
+			return
+		}
+		m := q.messages[0]
+		q.messages[0] = nil
+		q.messages = q.messages[1:]
+		f.mu.Unlock()
+
+		f.workers <- struct{}{}
+		err := f.handle(m)
+		<-f.workers
+		imsg.ReleaseMessage(m)
+
+		if err != nil {
+			f.fail(err)
+		}
+	}
+}
+
+// fail stops Serve with err, by closing the connection
+func (f *Filter) fail(err error) {
+	f.errOnce.Do(func() {
+		f.err = err
+		f.c.Close()
+	})
+}
+
+func (f *Filter) handle(m *imsg.Message) (err error) {
+	switch m.Header.Type {
 	case typeFilterEvent:
-		if err = f.handleEvent(); err != nil {
+		if err = f.handleEvent(m); err != nil {
 			return
 		}
 
 	case typeFilterquery:
-		if err = f.handlequery(); err != nil {
+		if err = f.handlequery(m); err != nil {
+			return
+		}
+
+	case typeFilterPipe:
+		if err = f.handlePipe(m); err != nil {
 			return
 		}
 	}
@@ -321,201 +698,599 @@ func (f *Filter) handle() (err error) {
 	return
 }
 
-func fdCount() int {
-	d, err := os.Open("/proc/self/fd")
-	if err != nil {
-		log.Printf("fdcount open: %v\n", err)
-		return -1
+func (f *Filter) handleEvent(m *imsg.Message) (err error) {
+	var event eventHeader
+	if err = imsg.Unmarshal(m, &event); err != nil {
+		return
 	}
-	defer d.Close()
-	fds, err := d.Readdirnames(-1)
-	if err != nil {
-		log.Printf("fdcount: %v\n", err)
-		return -1
+	id, t := event.ID, event.Type
+
+	if l := logAt(f.Logger, slog.LevelDebug); l != nil {
+		l.LogAttrs(context.Background(), slog.LevelDebug, "filter event",
+			idAttr("session", id),
+			slog.String("event", eventName(t)))
 	}
-	return len(fds) - 1 // -1 for os.Open...
-}
 
-func (f *Filter) handleEvent() (err error) {
 	var (
-		id uint64
-		t  int
+		s        *Session
+		callback func(*Session) error
 	)
-
-	if id, err = f.m.GetTypeID(); err != nil {
-		return
+	switch t {
+	case eventConnect:
+		s = f.addSession(id)
+		callback = f.Connected
+	case eventReset:
+		callback = f.Reset
+	case eventDisconnect:
+		defer f.removeSession(id)
+		callback = f.Disconnect
+	case eventTXBegin:
+		callback = f.Begin
+	case eventTXCommit:
+		callback = f.Commit
+	case eventTXRollback:
+		callback = f.Rollback
 	}
-	if t, err = f.m.GetTypeInt(); err != nil {
-		return
+	if s == nil {
+		s = f.getSession(id)
 	}
 
-	log.Printf("imsg event: %s [id=%#x]\n", eventName(t), id)
-	log.Printf("imsg event data: %q\n", f.m.Data[14:])
-	log.Printf("fdcount: %d [pid=%d]\n", fdCount(), os.Getpid())
-
 	switch t {
-	case eventConnect:
-		f.session.Add(id, NewSession(f, id))
-	case eventDisconnect:
-		f.session.Remove(id)
+	case eventReset, eventTXCommit, eventTXRollback:
+		// The callback still sees the transaction that ended, the
+		// message of an aborted one is dropped
+		s.dropPipe()
+		defer func() { s.Transaction = Transaction{} }()
 	}
 
+	if callback != nil && !s.refused {
+		return f.callEvent(s, t, func() error { return callback(s) })
+	}
 	return
 }
 
-func (f *Filter) handlequery() (err error) {
-	var (
-		id, qid uint64
-		t       int
-	)
-
-	if id, err = f.m.GetTypeID(); err != nil {
-		return
-	}
-	if qid, err = f.m.GetTypeID(); err != nil {
+func (f *Filter) handlequery(m *imsg.Message) (err error) {
+	var query queryHeader
+	if err = imsg.Unmarshal(m, &query); err != nil {
 		return
 	}
-	if t, err = f.m.GetTypeInt(); err != nil {
-		return
-	}
-
-	log.Printf("imsg query: %s [id=%#x,qid=%#x]\n", queryName(t), id, qid)
-	//log.Printf("imsg query data (%d remaining): %q\n", len(f.m.Data[f.m.rpos:]), f.m.Data[f.m.rpos:])
-	//log.Printf("fdcount: %d [pid=%d]\n", fdCount(), os.Getpid())
+	id, qid, t := query.ID, query.QID, query.Type
 
-	var s *Session
-	if cached, ok := f.session.Get(id); ok {
-		s = cached.(*Session)
-	} else {
-		s = NewSession(f, id)
-		f.session.Add(id, s)
+	if l := logAt(f.Logger, slog.LevelDebug); l != nil {
+		l.LogAttrs(context.Background(), slog.LevelDebug, "filter query",
+			idAttr("session", id),
+			idAttr("qid", qid),
+			slog.String("query", queryName(t)))
 	}
+
+	s := f.getSession(id)
+	s.mu.Lock()
 	s.qtype = t
 	s.qid = qid
+	s.responded = false
+	s.expired = false
+	s.startQuery()
+	s.mu.Unlock()
+
+	if s.refused {
+		return f.respond(s, VerdictTempfail.Status, VerdictTempfail.Code, VerdictTempfail.Line)
+	}
+	if t != queryEOM {
+		f.deadline(s, t, qid)
+	}
 
 	switch t {
 	case queryConnect:
 		var query ConnectQuery
-		if query.Local, err = f.m.GetTypeSockaddr(); err != nil {
-			return
-		}
-		if query.Remote, err = f.m.GetTypeSockaddr(); err != nil {
-			return
-		}
-		if query.Hostname, err = f.m.GetTypeString(); err != nil {
+		if err = imsg.Unmarshal(m, &query); err != nil {
 			return
 		}
 
-		log.Printf("query connect: %s\n", query)
+		s.Connect = &query
 		if f.Connect != nil {
-			return f.Connect(s, &query)
+			return f.callQuery(s, t, qid, func() error { return f.Connect(s, &query) })
 		}
 
-		log.Printf("filter: WARNING: no connect callback\n")
+		f.noCallback(s)
 
 	case queryHELO:
-		var line string
-		if line, err = f.m.GetTypeString(); err != nil {
+		var query heloQuery
+		if err = imsg.Unmarshal(m, &query); err != nil {
 			return
 		}
 
-		log.Printf("query HELO: %q\n", line)
+		s.HELO = query.Line
 		if f.HELO != nil {
-			return f.HELO(s, line)
+			return f.callQuery(s, t, qid, func() error { return f.HELO(s, query.Line) })
 		}
 
-		log.Printf("filter: WARNING: no HELO callback\n")
+		f.noCallback(s)
 		return f.respond(s, FilterOK, 0, "")
 
 	case queryMAIL:
-		var user, domain string
-		if user, domain, err = f.m.GetTypeMailaddr(); err != nil {
+		var query mailQuery
+		if err = imsg.Unmarshal(m, &query); err != nil {
 			return
 		}
 
-		log.Printf("query MAIL: %s\n", user+"@"+domain)
+		s.addr = query.Addr
 		if f.MAIL != nil {
-			return f.MAIL(s, user, domain)
+			return f.callQuery(s, t, qid, func() error { return f.MAIL(s, query.Addr.User, query.Addr.Domain) })
 		}
 
-		log.Printf("filter: WARNING: no MAIL callback\n")
+		f.noCallback(s)
 		return f.respond(s, FilterOK, 0, "")
 
 	case queryRCPT:
-		var user, domain string
-		if user, domain, err = f.m.GetTypeMailaddr(); err != nil {
+		var query mailQuery
+		if err = imsg.Unmarshal(m, &query); err != nil {
 			return
 		}
 
-		log.Printf("query RCPT: %s\n", user+"@"+domain)
+		s.addr = query.Addr
 		if f.RCPT != nil {
-			return f.RCPT(s, user, domain)
+			return f.callQuery(s, t, qid, func() error { return f.RCPT(s, query.Addr.User, query.Addr.Domain) })
 		}
 
-		log.Printf("filter: WARNING: no RCPT callback\n")
+		f.noCallback(s)
 		return f.respond(s, FilterOK, 0, "")
 
 	case queryDATA:
 		if f.DATA != nil {
-			return f.DATA(s)
+			return f.callQuery(s, t, qid, func() error { return f.DATA(s) })
 		}
 
-		log.Printf("filter: WARNING: no DATA callback\n")
+		f.noCallback(s)
 		return f.respond(s, FilterOK, 0, "")
 
 	case queryEOM:
-		var dataLen uint32
-		if dataLen, err = f.m.GetTypeUint32(); err != nil {
+		var (
+			query   eomQuery
+			message *Message
+		)
+		if err = imsg.Unmarshal(m, &query); err != nil {
 			return
 		}
+		s.datalen = query.DataLen
+		s.Transaction.DataLen = query.DataLen
+
+		if s.pipe != nil {
+			// Wait for the body to be filtered, smtpd wants to know
+			// how much we sent back
+			p := s.pipe
+			<-p.done
+			if p.err != nil {
+				s.pipe = nil
+				if f.Message != nil {
+					p.close()
+				}
+				return f.bodyFailed(s, qid, p.err)
+			}
+			if f.Message == nil {
+				s.datalen = p.n
+				s.pipe = nil
+			} else {
+				message = ParseMessage(p.body.Bytes())
+				s.message = message
+			}
+		}
+
+		// The deadline is for the callback, not for receiving the body
+		f.deadline(s, t, qid)
+
+		if message != nil {
+			return f.callQuery(s, t, qid, func() error { return f.Message(s, message) })
+		}
 
 		if f.EOM != nil {
-			return f.EOM(s, dataLen)
+			return f.callQuery(s, t, qid, func() error { return f.EOM(s, query.DataLen) })
 		}
 
-		log.Printf("filter: WARNING: no EOM callback\n")
+		f.noCallback(s)
 		return f.respond(s, FilterOK, 0, "")
 	}
 
 	return
 }
 
+// getSession returns the session with the given ID. Sessions we missed the
+// connect event of, for example because the filter was restarted, are added
+// to the table.
+func (f *Filter) getSession(id uint64) *Session {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.sessions[id]; ok {
+		s.lastSeen = time.Now()
+		return s
+	}
+	return f.addSessionLocked(id)
+}
+
+// addSession adds a new session to the table, replacing a previous one with
+// the same ID.
+func (f *Filter) addSession(id uint64) *Session {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addSessionLocked(id)
+}
+
+func (f *Filter) addSessionLocked(id uint64) *Session {
+	if f.sessions == nil {
+		f.sessions = make(map[uint64]*Session)
+	}
+	if s, ok := f.sessions[id]; ok {
+		s.dropPipe()
+		s.end()
+		delete(f.sessions, id)
+	}
+
+	s := NewSession(f, id)
+	s.lastSeen = s.Started
+	if f.MaxSessions > 0 && len(f.sessions) >= f.MaxSessions {
+		if l := logAt(f.Logger, slog.LevelWarn); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelWarn, "filter session limit reached, refusing session",
+				idAttr("session", id),
+				slog.Int("max_sessions", f.MaxSessions))
+		}
+		s.refused = true
+	}
+	f.sessions[id] = s
+	return s
+}
+
+func (f *Filter) removeSession(id uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.sessions[id]; ok {
+		s.dropPipe()
+		s.end()
+		delete(f.sessions, id)
+	}
+}
+
+// Sessions returns the active sessions, ordered by ID
+func (f *Filter) Sessions() []*Session {
+	f.mu.Lock()
+	sessions := make([]*Session, 0, len(f.sessions))
+	for _, s := range f.sessions {
+		sessions = append(sessions, s)
+	}
+	f.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// sweep drops leaked sessions, until stop is closed
+func (f *Filter) sweep(stop <-chan struct{}) {
+	// A timeout of 1ns would make a zero interval, which NewTicker refuses
+	interval := f.SessionTimeout / 2
+	if interval <= 0 {
+		interval = 1
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			f.dropLeaked(now)
+		}
+	}
+}
+
+func (f *Filter) dropLeaked(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, s := range f.sessions {
+		if _, busy := f.queues[id]; busy || now.Sub(s.lastSeen) < f.SessionTimeout {
+			continue
+		}
+		if l := logAt(f.Logger, slog.LevelWarn); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelWarn, "filter session leaked",
+				idAttr("session", id),
+				slog.Time("last_seen", s.lastSeen),
+				slog.Time("started", s.Started))
+		}
+		s.dropPipe()
+		s.end()
+		delete(f.sessions, id)
+	}
+}
+
+// handlePipe sets up the data pipe for a session. smtpd passes the
+// descriptor the message body is to be written to, and expects one back to
+// write the body it received to. Without DataLine or Body callback, we hand
+// smtpd its own descriptor.
+func (f *Filter) handlePipe(m *imsg.Message) (err error) {
+	var query pipeQuery
+	if err = imsg.Unmarshal(m, &query); err != nil {
+		return
+	}
+
+	out := m.File
+	m.File = nil
+	if l := logAt(f.Logger, slog.LevelDebug); l != nil {
+		l.LogAttrs(context.Background(), slog.LevelDebug, "filter pipe",
+			idAttr("session", query.ID),
+			slog.Bool("fd", out != nil))
+	}
+
+	reply := imsg.AcquireMessage(typeFilterPipe)
+	defer imsg.ReleaseMessage(reply)
+	if err = imsg.Marshal(reply, &query); err != nil {
+		return
+	}
+
+	switch {
+	case out == nil:
+		// smtpd fails the session if we don't return a descriptor either
+		if l := logAt(f.Logger, slog.LevelWarn); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelWarn, "filter pipe without descriptor",
+				idAttr("session", query.ID))
+		}
+
+	case f.DataLine == nil && f.Body == nil && f.Message == nil:
+		reply.File = out
+
+	default:
+		var in *os.File
+		if in, reply.File, err = os.Pipe(); err != nil {
+			out.Close()
+			return
+		}
+		s := f.getSession(query.ID)
+		// A new message, smtpd gave up on the previous one
+		s.dropPipe()
+		s.pipe = newDataPipe(in, out)
+		go s.pipe.run(s)
+	}
+
+	if err = f.c.WriteMessage(reply); err != nil && reply.File != nil {
+		reply.File.Close()
+	}
+	return
+}
+
+// deadline starts the response timer of a query, if the filter has one
+func (f *Filter) deadline(s *Session, t int, qid uint64) {
+	d, ok := f.HookTimeout[queryHook[t]]
+	if !ok {
+		d = f.Timeout
+	}
+	if d <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timer = time.AfterFunc(d, func() { f.expire(s, qid, "filter query not answered in time") })
+}
+
+// expire responds to a query that was not answered before its deadline, or
+// before shutdown
+func (f *Filter) expire(s *Session, qid uint64, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responded || s.qid != qid {
+		return
+	}
+
+	if l := logAt(f.Logger, slog.LevelWarn); l != nil {
+		l.LogAttrs(context.Background(), slog.LevelWarn, msg,
+			f.queryAttrs(s, slog.String("verdict", responseName(f.Fallback.Status)))...)
+	}
+	s.expired = true
+	if err := f.respondLocked(s, f.Fallback.Status, f.Fallback.Code, f.Fallback.Line); err != nil {
+		if l := logAt(f.Logger, slog.LevelError); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelError, "filter fallback response failed",
+				f.queryAttrs(s, slog.Any("error", err))...)
+		}
+	}
+}
+
 func (f *Filter) respond(s *Session, status, code int, line string) error {
-	log.Printf("filter: %s %s [code=%d,line=%q]\n", filterName(typeFilterResponse), responseName(status), code, line)
+	view := s
+	s = s.session()
+	s.mu.Lock()
+
+	// stale is set for a filter of a chain that answered already: the
+	// query was passed further down the chain, or is a new one
+	stale := view != s && (view.step != s.link || view.index != s.link.i)
+	if l := s.link; l != nil && !s.responded && !stale {
+		if status == FilterOK && l.i+1 < len(l.filters) {
+			// Accepted, pass the query along the chain
+			l.i++
+			t, qid, i := s.qtype, s.qid, l.i
+			s.mu.Unlock()
+			return f.callLink(s, t, qid, l, i)
+		}
+		s.link = nil
+	}
+	defer s.mu.Unlock()
 
-	if s.qtype == queryEOM {
-		// Not implemented
+	if s.responded && s.expired {
+		// Answered with the fallback already
+		if l := logAt(f.Logger, slog.LevelWarn); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelWarn, "filter late response ignored",
+				f.queryAttrs(s)...)
+		}
 		return nil
 	}
+	if s.responded || stale {
+		if l := logAt(f.Logger, slog.LevelWarn); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelWarn, "filter double response",
+				f.queryAttrs(s)...)
+		}
+		return ErrDoubleResponse
+	}
+	return f.respondLocked(s, status, code, line)
+}
+
+// respondLocked sends the response, with the session locked
+func (f *Filter) respondLocked(s *Session, status, code int, line string) error {
+	s.responded = true
+	s.link = nil
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	defer s.endQuery()
+
+	if l := logAt(f.Logger, slog.LevelDebug); l != nil {
+		l.LogAttrs(context.Background(), slog.LevelDebug, "filter response",
+			f.queryAttrs(s,
+				slog.String("verdict", responseName(status)),
+				slog.Int("code", code),
+				slog.String("line", line))...)
+	}
+
+	if s.qtype == queryEOM && s.message != nil {
+		if err := s.writeMessage(); err != nil {
+			return err
+		}
+	}
+
+	if status == FilterOK {
+		s.accepted()
+	}
 
-	m := new(message)
-	m.Header.Type = typeFilterResponse
-	m.PutTypeID(s.qid)
-	m.PutTypeInt(s.qtype)
+	m := imsg.AcquireMessage(typeFilterResponse)
+	defer imsg.ReleaseMessage(m)
+
+	var response interface{}
 	if s.qtype == queryEOM {
-		// Not imlemented
-		return nil
+		// smtpd expects the size of the message as it leaves the filter
+		response = &eomResponse{
+			QID:     s.qid,
+			Type:    s.qtype,
+			DataLen: s.datalen,
+			Status:  status,
+			Code:    code,
+			Line:    line,
+		}
+	} else {
+		response = &filterResponse{
+			QID:    s.qid,
+			Type:   s.qtype,
+			Status: status,
+			Code:   code,
+			Line:   line,
+		}
 	}
-	m.PutTypeInt(status)
-	m.PutTypeInt(code)
-	if line != "" {
-		m.PutTypeString(line)
+	if err := imsg.Marshal(m, response); err != nil {
+		return err
 	}
 
-	if err := m.WriteTo(f.c); err != nil {
-		log.Printf("filter: respond failed: %v\n", err)
+	if err := f.c.WriteMessage(m); err != nil {
+		if l := logAt(f.Logger, slog.LevelError); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelError, "filter response failed",
+				f.queryAttrs(s, slog.Any("error", err))...)
+		}
 		return err
 	}
 
 	return nil
 }
 
-// ConnectQuery are the QUERY_CONNECT arguments
+// noCallback logs a query answered without callback
+func (f *Filter) noCallback(s *Session) {
+	if l := logAt(f.Logger, slog.LevelWarn); l != nil {
+		l.LogAttrs(context.Background(), slog.LevelWarn, "filter query without callback",
+			f.queryAttrs(s)...)
+	}
+}
+
+// queryAttrs returns the log attributes of the current query of a session,
+// followed by attrs
+func (f *Filter) queryAttrs(s *Session, attrs ...slog.Attr) []slog.Attr {
+	return append([]slog.Attr{
+		idAttr("session", s.ID),
+		idAttr("qid", s.qid),
+		slog.String("query", queryName(s.qtype)),
+		slog.String("hook", queryHook[s.qtype].String()),
+	}, attrs...)
+}
+
+// ConnectQuery are the QUERY_CONNECT arguments. The addresses are a
+// *net.TCPAddr for network connections, or a *net.UnixAddr for local
+// submissions.
 type ConnectQuery struct {
-	Local, Remote net.Addr
-	Hostname      string
+	Local, Remote net.Addr `mproc:"sockaddr"`
+	Hostname      string   `mproc:"string"`
 }
 
 func (q ConnectQuery) String() string {
 	return fmt.Sprintf("%s -> %s [hostname=%s]", q.Remote, q.Local, q.Hostname)
 }
+
+// Sockaddr emulates the mess that is struct sockaddr
+type Sockaddr = imsg.Sockaddr
+
+// registerQuery are the IMSG_FILTER_REGISTER arguments
+type registerQuery struct {
+	Version uint32 `mproc:"uint32"`
+	Name    string `mproc:"string"`
+}
+
+// registerResponse is our IMSG_FILTER_REGISTER reply
+type registerResponse struct {
+	Hooks Hook `mproc:"int"`
+	Flags Flag `mproc:"int"`
+}
+
+// eventHeader are the IMSG_FILTER_EVENT arguments
+type eventHeader struct {
+	ID   uint64 `mproc:"id"`
+	Type int    `mproc:"int"`
+}
+
+// queryHeader precedes the arguments of every IMSG_FILTER_QUERY
+type queryHeader struct {
+	ID   uint64 `mproc:"id"`
+	QID  uint64 `mproc:"id"`
+	Type int    `mproc:"int"`
+}
+
+// pipeQuery are the IMSG_FILTER_PIPE arguments, and our reply
+type pipeQuery struct {
+	ID uint64 `mproc:"id"`
+}
+
+// heloQuery are the QUERY_HELO arguments
+type heloQuery struct {
+	Line string `mproc:"string"`
+}
+
+// mailQuery are the QUERY_MAIL and QUERY_RCPT arguments
+type mailQuery struct {
+	Addr Mailaddr `mproc:"mailaddr"`
+}
+
+// eomQuery are the QUERY_EOM arguments
+type eomQuery struct {
+	DataLen uint32 `mproc:"uint32"`
+}
+
+// filterResponse is our IMSG_FILTER_RESPONSE reply
+type filterResponse struct {
+	QID    uint64 `mproc:"id"`
+	Type   int    `mproc:"int"`
+	Status int    `mproc:"int"`
+	Code   int    `mproc:"int"`
+	Line   string `mproc:"string,omitempty"`
+}
+
+// eomResponse is our IMSG_FILTER_RESPONSE reply to QUERY_EOM
+type eomResponse struct {
+	QID     uint64 `mproc:"id"`
+	Type    int    `mproc:"int"`
+	DataLen uint32 `mproc:"uint32"`
+	Status  int    `mproc:"int"`
+	Code    int    `mproc:"int"`
+	Line    string `mproc:"string,omitempty"`
+}
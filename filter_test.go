@@ -1,13 +1,22 @@
 package opensmtpd
 
-import "strings"
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
 
 func ExampleFilter() {
 	// Build our filter
 	filter := &Filter{
 		HELO: func(session *Session, helo string) error {
 			if helo == "test" {
-				return session.Reject(FilterOK, 0)
+				return session.Permfail(EnhancedOther, "Hello rejected")
 			}
 			return session.Accept()
 		},
@@ -16,7 +25,7 @@ func ExampleFilter() {
 	// Add another hook
 	filter.MAIL = func(session *Session, user, domain string) error {
 		if strings.ToLower(domain) == "example.org" {
-			return session.Reject(FilterOK, 0)
+			return session.Respond(Verdict{Status: FilterFail, Code: 550, Line: "5.1.8 Sender rejected"})
 		}
 		return session.Accept()
 	}
@@ -30,3 +39,516 @@ func ExampleFilter() {
 	// And keep serving until smtpd stops
 	filter.Serve()
 }
+
+func BenchmarkFilterQuery(b *testing.B) {
+	ts := newTestSession(b, &Filter{
+		HELO: func(session *Session, helo string) error {
+			return session.Accept()
+		},
+	})
+
+	var (
+		f     = ts.f
+		query = ts.query(1, 2, queryHELO)
+		reply = new(imsg.Message)
+	)
+	query.PutTypeString("mx.example.org")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ts.smtpd.WriteMessage(query); err != nil {
+			b.Fatal(err)
+		}
+		if err := f.c.ReadMessage(f.m); err != nil {
+			b.Fatal(err)
+		}
+		if err := f.handle(f.m); err != nil {
+			b.Fatal(err)
+		}
+		if err := ts.smtpd.ReadMessage(reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFilterEOM(t *testing.T) {
+	ts := newTestSession(t, &Filter{
+		EOM: func(session *Session, datalen uint32) error {
+			if datalen != 1234 {
+				t.Errorf("expected datalen 1234, got %d", datalen)
+			}
+			return session.RejectCode(FilterFail, 554, "5.7.1 Message rejected")
+		},
+	})
+
+	query := ts.query(1, 2, queryEOM)
+	query.PutTypeUint32(1234)
+	ts.handle(query)
+
+	var response eomResponse
+	if reply := ts.reply(&response); reply.Header.Type != typeFilterResponse {
+		t.Fatalf("expected %s, got %s", filterName(typeFilterResponse), filterName(reply.Header.Type))
+	}
+	want := eomResponse{
+		QID:     2,
+		Type:    queryEOM,
+		DataLen: 1234,
+		Status:  FilterFail,
+		Code:    554,
+		Line:    "5.7.1 Message rejected",
+	}
+	if response != want {
+		t.Fatalf("expected %+v, got %+v", want, response)
+	}
+}
+
+func TestFilterPipe(t *testing.T) {
+	f := &Filter{
+		DataLine: func(session *Session, line string) error {
+			if strings.HasPrefix(line, "X-Drop:") {
+				return nil
+			}
+			return session.WriteLine(strings.ToUpper(line))
+		},
+		EOM: func(session *Session, datalen uint32) error {
+			return session.Accept()
+		},
+	}
+
+	filtered, response := testFilterPipe(t, f, "Subject: test\nX-Drop: yes\n\nhello\n.world")
+	if want := "SUBJECT: TEST\n\nHELLO\n.WORLD\n"; filtered != want {
+		t.Fatalf("expected body %q, got %q", want, filtered)
+	}
+	if response.Status != FilterOK || response.DataLen != uint32(len(filtered)) {
+		t.Fatalf("expected %s with datalen %d, got %+v", responseName(FilterOK), len(filtered), response)
+	}
+}
+
+func TestFilterMessage(t *testing.T) {
+	f := &Filter{
+		Message: func(session *Session, m *Message) error {
+			m.Header.Prepend("X-Filtered", "yes")
+			return session.Reject(FilterFail, 550)
+		},
+	}
+
+	filtered, response := testFilterPipe(t, f, "Subject: test\n\nhello\n")
+	if want := "X-Filtered: yes\nSubject: test\n\nhello\n"; filtered != want {
+		t.Fatalf("expected body %q, got %q", want, filtered)
+	}
+	if response.Status != FilterFail || response.Code != 550 || response.DataLen != uint32(len(filtered)) {
+		t.Fatalf("expected %s with datalen %d, got %+v", responseName(FilterFail), len(filtered), response)
+	}
+}
+
+func TestFilterMessageDeadline(t *testing.T) {
+	f := &Filter{
+		Message: func(session *Session, m *Message) error {
+			// Still busy with the message when the query expires
+			ctx := session.Context()
+			for ctx.Err() == nil {
+				m.Header.Add("X-Busy", "yes")
+			}
+			return session.Accept()
+		},
+		HookTimeout: map[Hook]time.Duration{HookEOM: time.Millisecond},
+		Fallback:    VerdictTempfail,
+	}
+
+	body := "Subject: test\n\nhello\n"
+	filtered, response := testFilterPipe(t, f, body)
+	if filtered != body {
+		t.Fatalf("expected the message as received %q, got %q", body, filtered)
+	}
+	if response.Status != FilterFail || response.Code != 451 || response.DataLen != uint32(len(body)) {
+		t.Fatalf("expected fallback %+v with datalen %d, got %+v", VerdictTempfail, len(body), response)
+	}
+}
+
+// testFilterPipe passes body through the data pipe of f, and returns the
+// filtered body with the EOM response.
+func testFilterPipe(t *testing.T, f *Filter, body string) (string, eomResponse) {
+	t.Helper()
+	ts := newTestSession(t, f)
+
+	// smtpd hands us the descriptor to write the body to
+	out, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	pipe := imsg.NewMessage(typeFilterPipe)
+	pipe.PutTypeID(1)
+	pipe.File = w
+	ts.handle(pipe)
+
+	reply := ts.reply(nil)
+	if reply.Header.Type != typeFilterPipe || reply.File == nil {
+		t.Fatalf("expected %s with descriptor, got %s", filterName(typeFilterPipe), filterName(reply.Header.Type))
+	}
+	if id, err := reply.GetTypeID(); err != nil || id != 1 {
+		t.Fatalf("expected id 1, got %d (%v)", id, err)
+	}
+	if _, err = io.WriteString(reply.File, body); err != nil {
+		t.Fatal(err)
+	}
+	reply.File.Close()
+
+	eom := ts.query(1, 2, queryEOM)
+	eom.PutTypeUint32(uint32(len(body)))
+	ts.handle(eom)
+
+	filtered, err := io.ReadAll(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response eomResponse
+	ts.reply(&response)
+	return string(filtered), response
+}
+
+func TestFilterPipeAbort(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		f     *Filter
+		abort func(ts *testSession)
+	}{
+		{"message rollback", &Filter{Message: func(s *Session, m *Message) error { return s.Accept() }},
+			func(ts *testSession) { ts.event(1, eventTXRollback) }},
+		{"message reset", &Filter{Message: func(s *Session, m *Message) error { return s.Accept() }},
+			func(ts *testSession) { ts.event(1, eventReset) }},
+		{"message disconnect", &Filter{Message: func(s *Session, m *Message) error { return s.Accept() }},
+			func(ts *testSession) { ts.event(1, eventDisconnect) }},
+		{"dataline disconnect", &Filter{DataLine: func(s *Session, line string) error { return s.WriteLine(line) }},
+			func(ts *testSession) { ts.event(1, eventDisconnect) }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestSession(t, test.f)
+			ts.event(1, eventConnect)
+
+			// smtpd hands us a pipe per message, and keeps its end of
+			// ours open while the transaction is aborted
+			pipe := func() *os.File {
+				t.Helper()
+				out, w, err := os.Pipe()
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { out.Close() })
+				m := imsg.NewMessage(typeFilterPipe)
+				m.PutTypeID(1)
+				m.File = w
+				ts.handle(m)
+
+				reply := ts.reply(nil)
+				if reply.File == nil {
+					t.Fatal("expected a descriptor")
+				}
+				t.Cleanup(func() { reply.File.Close() })
+				if _, err = io.WriteString(reply.File, "Subject: test\n"); err != nil {
+					t.Fatal(err)
+				}
+				return out
+			}
+
+			// The second message replaces the first one
+			first := pipe()
+			second := pipe()
+			test.abort(ts)
+
+			for _, out := range []*os.File{first, second} {
+				out.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := io.ReadAll(out); err != nil {
+					t.Fatalf("expected the pipe to smtpd to be closed, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterEvents(t *testing.T) {
+	var events []string
+	callback := func(name string) func(*Session) error {
+		return func(session *Session) error {
+			if session.ID != 1 {
+				t.Errorf("%s: expected session 1, got %d", name, session.ID)
+			}
+			events = append(events, name)
+			return nil
+		}
+	}
+
+	f := &Filter{
+		Connected:  callback("connected"),
+		Reset:      callback("reset"),
+		Disconnect: callback("disconnect"),
+		Begin:      callback("begin"),
+		Commit:     callback("commit"),
+		Rollback:   callback("rollback"),
+	}
+	ts := newTestSession(t, f)
+
+	for _, event := range []int{eventConnect, eventTXBegin, eventTXRollback, eventReset, eventTXBegin, eventTXCommit, eventDisconnect} {
+		ts.event(1, event)
+	}
+
+	want := "connected,begin,rollback,reset,begin,commit,disconnect"
+	if got := strings.Join(events, ","); got != want {
+		t.Fatalf("expected events %s, got %s", want, got)
+	}
+	if len(f.Sessions()) != 0 {
+		t.Fatal("session not removed on disconnect")
+	}
+}
+
+func TestFilterServeConcurrent(t *testing.T) {
+	var (
+		release = make(chan struct{})
+		order   = make(chan string, 4)
+	)
+	f := &Filter{
+		HELO: func(session *Session, helo string) error {
+			if session.ID == 1 {
+				// A slow lookup, answered from another goroutine
+				go func() {
+					<-release
+					session.Accept()
+				}()
+				return nil
+			}
+			return session.Accept()
+		},
+		MAIL: func(session *Session, user, domain string) error {
+			order <- user
+			return session.Accept()
+		},
+		ready: true,
+	}
+	ts := newTestSession(t, f)
+
+	done := make(chan error)
+	go func() { done <- f.Serve() }()
+
+	readQID := func() uint64 {
+		t.Helper()
+		var response filterResponse
+		ts.reply(&response)
+		return response.QID
+	}
+
+	for id := uint64(1); id <= 2; id++ {
+		m := ts.query(id, id*10, queryHELO)
+		m.PutTypeString("mx.example.org")
+		ts.write(m)
+	}
+	if qid := readQID(); qid != 20 {
+		t.Fatalf("expected session 2 to be answered first, got qid %d", qid)
+	}
+	close(release)
+	if qid := readQID(); qid != 10 {
+		t.Fatalf("expected session 1 to be answered, got qid %d", qid)
+	}
+
+	// Queries of one session are handled in order
+	for i, user := range []string{"a", "b", "c"} {
+		m := ts.query(3, uint64(30+i), queryMAIL)
+		m.PutTypeMailaddr(user, "example.org")
+		ts.write(m)
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		if user := <-order; user != want {
+			t.Fatalf("expected MAIL %s, got %s", want, user)
+		}
+		readQID()
+	}
+
+	ts.smtpd.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterDeadline(t *testing.T) {
+	late := make(chan error)
+	ts := newTestSession(t, &Filter{
+		HELO: func(session *Session, helo string) error {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				late <- session.Accept()
+			}()
+			return nil
+		},
+		MAIL: func(session *Session, user, domain string) error {
+			session.Accept()
+			return session.Accept()
+		},
+		Timeout:     time.Hour,
+		HookTimeout: map[Hook]time.Duration{HookHELO: 10 * time.Millisecond},
+		Fallback:    VerdictTempfail,
+	})
+
+	send := func(m *imsg.Message) (response filterResponse) {
+		t.Helper()
+		if err := ts.send(m); err != nil && err != ErrDoubleResponse {
+			t.Fatal(err)
+		}
+		ts.reply(&response)
+		return
+	}
+
+	m := ts.query(1, 2, queryHELO)
+	m.PutTypeString("mx.example.org")
+	if response := send(m); response.Status != FilterFail || response.Code != 451 {
+		t.Fatalf("expected fallback %+v, got %+v", VerdictTempfail, response)
+	}
+	if err := <-late; err != nil {
+		t.Fatalf("late response: %v", err)
+	}
+
+	m = ts.query(1, 3, queryMAIL)
+	m.PutTypeMailaddr("joe", "example.org")
+	if response := send(m); response.Status != FilterOK || response.QID != 3 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+
+	// Neither the late nor the double response reached smtpd
+	ts.smtpd.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err := ts.smtpd.ReadMessage(new(imsg.Message)); err == nil {
+		t.Fatal("unexpected second response")
+	}
+}
+
+func TestFilterServeContext(t *testing.T) {
+	started := make(chan struct{})
+	f := &Filter{
+		HELO: func(session *Session, helo string) error {
+			// A slow lookup, given up on shutdown
+			close(started)
+			<-session.Context().Done()
+			return nil
+		},
+		Fallback: VerdictTempfail,
+		ready:    true,
+	}
+	ts := newTestSession(t, f)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- f.ServeContext(ctx) }()
+
+	m := ts.query(1, 2, queryHELO)
+	m.PutTypeString("mx.example.org")
+	ts.write(m)
+	<-started
+	cancel()
+
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+
+	// The pending query was answered before returning
+	var response filterResponse
+	ts.reply(&response)
+	if response.QID != 2 || response.Status != FilterFail || response.Code != 451 {
+		t.Fatalf("expected fallback %+v, got %+v", VerdictTempfail, response)
+	}
+}
+
+func TestFilterRegisterVersions(t *testing.T) {
+	for _, test := range []struct {
+		version uint32
+		ok      bool
+	}{
+		{50, false},
+		{51, true},
+		{52, true},
+		{53, false},
+	} {
+		f := &Filter{
+			HELO: func(session *Session, helo string) error {
+				return session.Accept()
+			},
+		}
+		response, err := testRegister(t, f, test.version)
+		if !test.ok {
+			if _, ok := err.(UnsupportedVersionError); !ok {
+				t.Fatalf("version %d: expected UnsupportedVersionError, got %v", test.version, err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("version %d: %v", test.version, err)
+		}
+		if response.Hooks != HookHELO {
+			t.Fatalf("version %d: expected hooks %s, got %s", test.version, HookHELO, response.Hooks)
+		}
+	}
+}
+
+func TestFilterRegisterFlags(t *testing.T) {
+	helo := func(session *Session, helo string) error {
+		return session.Accept()
+	}
+	body := func(session *Session, r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	reset := func(session *Session) error {
+		return nil
+	}
+
+	for _, test := range []struct {
+		f  *Filter
+		ok bool
+	}{
+		{&Filter{HELO: helo, Flags: FlagAlterData}, false},
+		{&Filter{Body: body, Flags: FlagAlterData}, true},
+		{&Filter{HELO: helo, Flags: FlagEvents}, false},
+		{&Filter{Reset: reset, Flags: FlagEvents}, true},
+		{&Filter{HELO: helo, Flags: 0x80}, false},
+	} {
+		response, err := testRegister(t, test.f, FilterVersion)
+		if !test.ok {
+			if err == nil {
+				t.Fatalf("flags %s: expected error", test.f.Flags)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("flags %s: %v", test.f.Flags, err)
+		}
+		if response.Flags != test.f.Flags {
+			t.Fatalf("expected flags %s, got %s", test.f.Flags, response.Flags)
+		}
+	}
+}
+
+// testRegister registers f with the given filter API version, and returns
+// the response sent to smtpd.
+func testRegister(t *testing.T, f *Filter, version uint32) (response registerResponse, err error) {
+	t.Helper()
+	var smtpd *conn
+	f.c, smtpd = testConnPair(t)
+	if f.Logger == nil {
+		f.Logger = testDiscard
+	}
+
+	m := imsg.NewMessage(typeFilterRegister)
+	if err = imsg.Marshal(m, &registerQuery{Version: version, Name: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = smtpd.WriteMessage(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Register(); err != nil {
+		return
+	}
+	if err = smtpd.ReadMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	if err = imsg.Unmarshal(m, &response); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package opensmtpd
+
+import (
+	"testing"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
+// testSession plays smtpd for a filter under test. Messages sent with send
+// are handled synchronously, without Serve.
+type testSession struct {
+	tb    testing.TB
+	f     *Filter
+	smtpd *conn
+}
+
+// newTestSession connects f to a test smtpd, filters without Logger log to
+// io.Discard.
+func newTestSession(tb testing.TB, f *Filter) *testSession {
+	tb.Helper()
+	if f.Logger == nil {
+		f.Logger = testDiscard
+	}
+	c, smtpd := testConnPair(tb)
+	f.c, f.m = c, new(imsg.Message)
+	f.c.logger = f.Logger
+	return &testSession{tb: tb, f: f, smtpd: smtpd}
+}
+
+// write sends a message to the filter, without handling it
+func (ts *testSession) write(m *imsg.Message) {
+	ts.tb.Helper()
+	if err := ts.smtpd.WriteMessage(m); err != nil {
+		ts.tb.Fatal(err)
+	}
+}
+
+// send passes a message to the filter, and returns the error of its handler
+func (ts *testSession) send(m *imsg.Message) error {
+	ts.tb.Helper()
+	ts.write(m)
+	if err := ts.f.c.ReadMessage(ts.f.m); err != nil {
+		ts.tb.Fatal(err)
+	}
+	return ts.f.handle(ts.f.m)
+}
+
+// handle is like send, the handler must not fail
+func (ts *testSession) handle(m *imsg.Message) {
+	ts.tb.Helper()
+	if err := ts.send(m); err != nil {
+		ts.tb.Fatal(err)
+	}
+}
+
+// event sends an event of session id
+func (ts *testSession) event(id uint64, t int) {
+	ts.tb.Helper()
+	m := imsg.NewMessage(typeFilterEvent)
+	m.PutTypeID(id)
+	m.PutTypeInt(t)
+	ts.handle(m)
+}
+
+// query returns the header of a query of session id, the arguments of the
+// query are to be added
+func (ts *testSession) query(id, qid uint64, t int) *imsg.Message {
+	m := imsg.NewMessage(typeFilterquery)
+	m.PutTypeID(id)
+	m.PutTypeID(qid)
+	m.PutTypeInt(t)
+	return m
+}
+
+// reply reads the next message of the filter, and unmarshals it into v
+func (ts *testSession) reply(v interface{}) *imsg.Message {
+	ts.tb.Helper()
+	m := new(imsg.Message)
+	if err := ts.smtpd.ReadMessage(m); err != nil {
+		ts.tb.Fatal(err)
+	}
+	if v != nil {
+		if err := imsg.Unmarshal(m, v); err != nil {
+			ts.tb.Fatal(err)
+		}
+	}
+	return m
+}
+
+// roundTrip sends a query, and returns the response of the filter
+func (ts *testSession) roundTrip(m *imsg.Message) (response filterResponse) {
+	ts.tb.Helper()
+	ts.handle(m)
+	ts.reply(&response)
+	return
+}
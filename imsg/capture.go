@@ -0,0 +1,192 @@
+package imsg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Capture files start with a magic, followed by the records. Each record
+// has a fixed size header:
+//
+//	direction  uint8
+//	flags      uint8
+//	reserved   uint16
+//	time       int64, nanoseconds since the UNIX epoch
+//	size       uint32, size of the frame
+//
+// followed by the frame as it was sent on the wire. All integers are little
+// endian. Passed file descriptors are not captured, the record is marked
+// instead.
+const (
+	captureMagic      = "IMSGCAP\x01"
+	captureHeaderSize = 1 + 1 + 2 + 8 + 4
+
+	captureFlagHasFD = 1
+)
+
+// ErrNotCapture is returned if a capture file does not start with the magic
+var ErrNotCapture = errors.New("imsg: not a capture file")
+
+// Direction of a captured frame, as seen by the proc
+type Direction uint8
+
+// Directions
+const (
+	// In frames are sent by smtpd to the proc
+	In Direction = iota + 1
+
+	// Out frames are sent by the proc to smtpd
+	Out
+)
+
+func (d Direction) String() string {
+	switch d {
+	case In:
+		return "in"
+	case Out:
+		return "out"
+	default:
+		return fmt.Sprintf("UNKNOWN %d", uint8(d))
+	}
+}
+
+// Record is a captured frame
+type Record struct {
+	Direction Direction
+	Time      time.Time
+
+	// HasFD is set if a file descriptor was passed with the frame
+	HasFD bool
+
+	// Frame is the raw frame, including the header
+	Frame []byte
+}
+
+// Message decodes the captured frame
+func (r *Record) Message() (*Message, error) {
+	if len(r.Frame) < HeaderSize {
+		return nil, fmt.Errorf("%w %d", ErrInvalidLength, len(r.Frame))
+	}
+
+	m := new(Message)
+	m.Header.decode(r.Frame)
+	if int(m.Header.Len) != len(r.Frame) {
+		return nil, fmt.Errorf("%w %d, frame has %d bytes", ErrInvalidLength, m.Header.Len, len(r.Frame))
+	}
+	m.Data = append(m.Data, r.Frame[HeaderSize:]...)
+	return m, nil
+}
+
+// CaptureWriter writes a capture file, it is safe for concurrent use.
+type CaptureWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	buf    []byte
+	header bool
+}
+
+// NewCaptureWriter returns a CaptureWriter writing to w
+func NewCaptureWriter(w io.Writer) *CaptureWriter {
+	return &CaptureWriter{w: w}
+}
+
+// WriteRecord appends a record to the capture
+func (cw *CaptureWriter) WriteRecord(r *Record) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	cw.buf = cw.buf[:0]
+	if !cw.header {
+		cw.buf = append(cw.buf, captureMagic...)
+	}
+	cw.buf = appendRecordHeader(cw.buf, r.Direction, r.Time, r.HasFD, len(r.Frame))
+	cw.buf = append(cw.buf, r.Frame...)
+	if _, err := cw.w.Write(cw.buf); err != nil {
+		return err
+	}
+	cw.header = true
+	return nil
+}
+
+// WriteMessage appends a record for a message that was just decoded or
+// encoded, so its header is complete.
+func (cw *CaptureWriter) WriteMessage(dir Direction, m *Message) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	cw.buf = cw.buf[:0]
+	if !cw.header {
+		cw.buf = append(cw.buf, captureMagic...)
+	}
+	cw.buf = appendRecordHeader(cw.buf, dir, time.Now(), m.Header.Flags&FlagHasFD != 0, m.Len())
+	cw.buf = m.Header.appendTo(cw.buf)
+	cw.buf = append(cw.buf, m.Data...)
+	if _, err := cw.w.Write(cw.buf); err != nil {
+		return err
+	}
+	cw.header = true
+	return nil
+}
+
+func appendRecordHeader(b []byte, dir Direction, t time.Time, hasFD bool, size int) []byte {
+	var flags uint8
+	if hasFD {
+		flags |= captureFlagHasFD
+	}
+	b = append(b, uint8(dir), flags, 0, 0)
+	b = binary.LittleEndian.AppendUint64(b, uint64(t.UnixNano()))
+	return binary.LittleEndian.AppendUint32(b, uint32(size))
+}
+
+// CaptureReader reads a capture file
+type CaptureReader struct {
+	r      *bufio.Reader
+	header bool
+}
+
+// NewCaptureReader returns a CaptureReader reading from r
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r)}
+}
+
+// ReadRecord reads the next record, it returns io.EOF at the end of the
+// capture.
+func (cr *CaptureReader) ReadRecord() (*Record, error) {
+	if !cr.header {
+		var magic [len(captureMagic)]byte
+		if _, err := io.ReadFull(cr.r, magic[:]); err == io.EOF {
+			return nil, io.EOF
+		} else if err != nil || string(magic[:]) != captureMagic {
+			return nil, ErrNotCapture
+		}
+		cr.header = true
+	}
+
+	var head [captureHeaderSize]byte
+	if _, err := io.ReadFull(cr.r, head[:]); err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncated
+	} else if err != nil {
+		return nil, err
+	}
+
+	size := binary.LittleEndian.Uint32(head[12:])
+	if size > MaxSize {
+		return nil, fmt.Errorf("%w %d", ErrInvalidLength, size)
+	}
+
+	r := &Record{
+		Direction: Direction(head[0]),
+		HasFD:     head[1]&captureFlagHasFD != 0,
+		Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(head[4:]))),
+		Frame:     make([]byte, size),
+	}
+	if _, err := io.ReadFull(cr.r, r.Frame); err != nil {
+		return nil, ErrTruncated
+	}
+	return r, nil
+}
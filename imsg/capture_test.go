@@ -0,0 +1,84 @@
+package imsg
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	var (
+		buf bytes.Buffer
+		cw  = NewCaptureWriter(&buf)
+		in  = testQuery()
+		out = NewMessage(4)
+	)
+	out.PutTypeInt(0)
+
+	// Encode both, so the headers are complete
+	if err := NewEncoder(io.Discard).Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	in.Header.Flags |= FlagHasFD
+	if err := NewEncoder(io.Discard).Encode(out); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cw.WriteMessage(In, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.WriteMessage(Out, out); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 42)
+	if err := cw.WriteRecord(&Record{Direction: Out, Time: now, Frame: testFrame(t, 5, "raw")}); err != nil {
+		t.Fatal(err)
+	}
+
+	cr := NewCaptureReader(&buf)
+	for i, want := range []struct {
+		dir   Direction
+		hasFD bool
+		m     *Message
+	}{
+		{In, true, in},
+		{Out, false, out},
+	} {
+		r, err := cr.ReadRecord()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if r.Direction != want.dir || r.HasFD != want.hasFD {
+			t.Fatalf("record %d: unexpected %s, fd %t", i, r.Direction, r.HasFD)
+		}
+		m, err := r.Message()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(m.Header, want.m.Header) || !bytes.Equal(m.Data, want.m.Data) {
+			t.Fatalf("record %d: expected %+v %q, got %+v %q", i, want.m.Header, want.m.Data, m.Header, m.Data)
+		}
+	}
+
+	r, err := cr.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Time.Equal(now) || !bytes.Equal(r.Frame, testFrame(t, 5, "raw")) {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if _, err = cr.ReadRecord(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestCaptureReaderInvalid(t *testing.T) {
+	if _, err := NewCaptureReader(bytes.NewBufferString("not a capture")).ReadRecord(); err != ErrNotCapture {
+		t.Fatalf("expected %v, got %v", ErrNotCapture, err)
+	}
+	if _, err := NewCaptureReader(bytes.NewBufferString(captureMagic + "\x01")).ReadRecord(); err != ErrTruncated {
+		t.Fatalf("expected %v, got %v", ErrTruncated, err)
+	}
+}
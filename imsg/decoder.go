@@ -0,0 +1,151 @@
+package imsg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	// readSize is the size of the read buffer, any frame fits
+	readSize = 65535
+
+	// maxFDs is the number of descriptors we accept per read
+	maxFDs = 4
+)
+
+var (
+	// ErrAgain is returned if the transport has no data available yet
+	// (EAGAIN), the read may be retried.
+	ErrAgain = errors.New("imsg: resource temporarily unavailable")
+
+	// ErrTruncated is returned if the stream ends in the middle of a frame.
+	ErrTruncated = errors.New("imsg: truncated frame")
+
+	// ErrInvalidLength is returned if a frame header has a length shorter
+	// than the header, or longer than MaxSize. The stream can not be
+	// resynchronised after this error.
+	ErrInvalidLength = errors.New("imsg: invalid frame length")
+)
+
+// unixReader can receive file descriptors (implemented by net.UnixConn)
+type unixReader interface {
+	ReadMsgUnix(b, oob []byte) (n, oobn, flags int, addr *net.UnixAddr, err error)
+}
+
+// Decoder reads imsg frames from a stream. Short reads are reassembled and
+// coalesced frames are split, if the reader is a UNIX domain socket passed
+// file descriptors are attached to their message.
+type Decoder struct {
+	r io.Reader
+
+	// buf is what we read from the socket (and remains)
+	buf []byte
+
+	// fds are the received file descriptors not yet claimed by a frame
+	fds []*os.File
+
+	// oob is the ancillary data buffer
+	oob [maxFDs * 24]byte // CMSG_SPACE(sizeof(int)) is at most 24 bytes
+}
+
+// NewDecoder returns a Decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the next message from the stream into m.
+func (d *Decoder) Decode(m *Message) (err error) {
+	for {
+		var ok bool
+		if ok, err = d.parse(m); ok || err != nil {
+			return
+		}
+
+		if d.buf == nil {
+			d.buf = make([]byte, 0, readSize)
+		}
+
+		var n int
+		if ur, ok := d.r.(unixReader); ok {
+			n, err = d.readMsgUnix(ur)
+		} else {
+			n, err = d.r.Read(d.buf[len(d.buf):cap(d.buf)])
+		}
+		if n > 0 {
+			// Some transports report -1 along with an error
+			d.buf = d.buf[:len(d.buf)+n]
+		}
+
+		if err != nil {
+			if ok, perr := d.parse(m); ok || perr != nil {
+				// Report the read error on the next call
+				return perr
+			}
+			switch {
+			case err == io.EOF && len(d.buf) > 0:
+				err = ErrTruncated
+			case errors.Is(err, syscall.EAGAIN):
+				err = ErrAgain
+			}
+			return
+		}
+	}
+}
+
+// readMsgUnix reads into the buffer and queues the received descriptors.
+func (d *Decoder) readMsgUnix(r unixReader) (int, error) {
+	n, oobn, _, _, err := r.ReadMsgUnix(d.buf[len(d.buf):cap(d.buf)], d.oob[:syscall.CmsgSpace(maxFDs*4)])
+	if oobn > 0 {
+		cmsgs, cerr := syscall.ParseSocketControlMessage(d.oob[:oobn])
+		if cerr != nil {
+			return n, cerr
+		}
+		for _, cmsg := range cmsgs {
+			fds, cerr := syscall.ParseUnixRights(&cmsg)
+			if cerr != nil {
+				continue
+			}
+			for _, fd := range fds {
+				d.fds = append(d.fds, os.NewFile(uintptr(fd), "imsg"))
+			}
+		}
+	}
+	return n, err
+}
+
+// parse decodes one frame from the read buffer, if it is complete.
+func (d *Decoder) parse(m *Message) (bool, error) {
+	if len(d.buf) < HeaderSize {
+		return false, nil
+	}
+
+	var h Header
+	h.decode(d.buf)
+
+	size := int(h.Len)
+	if size < HeaderSize || size > MaxSize {
+		return false, fmt.Errorf("%w %d", ErrInvalidLength, size)
+	}
+	if len(d.buf) < size {
+		return false, nil
+	}
+
+	m.Header = h
+	m.File = nil
+	if h.Flags&FlagHasFD != 0 {
+		if len(d.fds) == 0 {
+			return false, errors.New("imsg: frame has a file descriptor, but none was received")
+		}
+		m.File, d.fds = d.fds[0], d.fds[1:]
+	}
+
+	m.Data = append(m.Data[:0], d.buf[HeaderSize:size]...)
+	m.rpos = 0
+	d.buf = d.buf[:copy(d.buf, d.buf[size:])]
+
+	return true, nil
+}
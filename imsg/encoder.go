@@ -0,0 +1,73 @@
+package imsg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// ErrTooLarge is returned if a message exceeds MaxSize
+var ErrTooLarge = errors.New("imsg: message too large")
+
+// unixWriter can send file descriptors (implemented by net.UnixConn)
+type unixWriter interface {
+	WriteMsgUnix(b, oob []byte, addr *net.UnixAddr) (n, oobn int, err error)
+}
+
+// Encoder writes imsg frames to a stream.
+type Encoder struct {
+	w io.Writer
+
+	// buf is the frame being sent, reused between calls
+	buf []byte
+}
+
+// NewEncoder returns an Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode marshals the message to wire format and sends it. If the message
+// carries a File, the writer must be able to pass file descriptors. Messages
+// exceeding MaxSize are refused with ErrTooLarge.
+func (e *Encoder) Encode(m *Message) error {
+	if n := m.Len(); n > MaxSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrTooLarge, n, MaxSize)
+	}
+	m.Header.Len = uint16(m.Len())
+	if m.File != nil {
+		m.Header.Flags |= FlagHasFD
+	}
+
+	e.buf = m.Header.appendTo(e.buf[:0])
+	e.buf = append(e.buf, m.Data...)
+
+	if m.File == nil {
+		_, err := e.w.Write(e.buf)
+		return err
+	}
+
+	uw, ok := e.w.(unixWriter)
+	if !ok {
+		return errors.New("imsg: transport can not pass file descriptors")
+	}
+	n, _, err := uw.WriteMsgUnix(e.buf, syscall.UnixRights(int(m.File.Fd())), nil)
+	if err != nil {
+		return err
+	}
+
+	// Like imsg(3), the descriptor is ours no longer
+	cerr := m.File.Close()
+	m.File = nil
+
+	// The descriptor went with the first chunk, a stream socket may take
+	// the rest of the frame separately
+	if n < len(e.buf) {
+		if _, err = e.w.Write(e.buf[n:]); err != nil {
+			return err
+		}
+	}
+	return cerr
+}
@@ -0,0 +1,502 @@
+// Package imsg implements the OpenBSD imsg framing and the smtpd mproc
+// encoding used by OpenSMTPD to talk to its filter, table and queue procs.
+//
+// # Size limits
+//
+// An imsg, header included, can not exceed MaxSize bytes. Neither imsg nor
+// mproc have a way to continue a value in a following message, smtpd simply
+// refuses oversized frames. The Encoder therefore fails with ErrTooLarge
+// before anything is written, and the Decoder rejects frames with a length
+// outside of the valid range with ErrInvalidLength. Procs that produce
+// values of unbounded size, like table lookup results or envelopes, have to
+// check Message.Len and answer with a failure instead of the value.
+package imsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderSize is the size of an imsg header on the wire
+	HeaderSize = 4 + 2 + 2 + 4 + 4
+
+	// MaxSize is the maximum size of an imsg, including the header
+	MaxSize = 16384
+
+	// Version is the imsg version, sent as peer ID
+	Version = 14
+
+	// FlagHasFD is set in the header flags if a file descriptor is passed
+	FlagHasFD = 1
+
+	maxLocalPartSize  = (255 + 1)
+	maxDomainPartSize = (255 + 1)
+)
+
+// Header is the header of an imsg frame (struct imsg_hdr)
+type Header struct {
+	Type   uint32
+	Len    uint16
+	Flags  uint16
+	PeerID uint32
+	PID    uint32
+}
+
+// appendTo appends the wire format of the header to b
+func (h *Header) appendTo(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, h.Type)
+	b = binary.LittleEndian.AppendUint16(b, h.Len)
+	b = binary.LittleEndian.AppendUint16(b, h.Flags)
+	b = binary.LittleEndian.AppendUint32(b, h.PeerID)
+	return binary.LittleEndian.AppendUint32(b, h.PID)
+}
+
+// decode the header from the wire format in b
+func (h *Header) decode(b []byte) {
+	_ = b[HeaderSize-1]
+	h.Type = binary.LittleEndian.Uint32(b[0:])
+	h.Len = binary.LittleEndian.Uint16(b[4:])
+	h.Flags = binary.LittleEndian.Uint16(b[6:])
+	h.PeerID = binary.LittleEndian.Uint32(b[8:])
+	h.PID = binary.LittleEndian.Uint32(b[12:])
+}
+
+// Message implements OpenBSD imsg
+type Message struct {
+	Header Header
+
+	// Data is the message payload.
+	Data []byte
+
+	// File is the file descriptor passed along with the message, if any.
+	// When encoding, the file is closed after it has been sent.
+	File *os.File
+
+	// rpos is the read position in the current Data
+	rpos int
+}
+
+// pid is sent in the header of every message
+var pid = uint32(os.Getpid())
+
+var pool = sync.Pool{
+	New: func() interface{} { return new(Message) },
+}
+
+// NewMessage returns an empty message of the specified type
+func NewMessage(t uint32) *Message {
+	m := new(Message)
+	m.Reset()
+	m.Header.Type = t
+	return m
+}
+
+// AcquireMessage returns an empty message of the specified type from a
+// pool, avoiding allocations for messages that are sent and then dropped.
+// The message must be given back with ReleaseMessage.
+func AcquireMessage(t uint32) *Message {
+	m := pool.Get().(*Message)
+	m.Reset()
+	m.Header.Type = t
+	return m
+}
+
+// ReleaseMessage puts a message obtained by AcquireMessage back into the
+// pool, it must not be used afterwards.
+func ReleaseMessage(m *Message) {
+	if cap(m.Data) > MaxSize {
+		// Don't hold on to outsized buffers
+		return
+	}
+	m.File = nil
+	pool.Put(m)
+}
+
+// Reset clears the message, so it can be reused for sending
+func (m *Message) Reset() {
+	m.Header.Type = 0
+	m.Header.Len = 0
+	m.Header.Flags = 0
+	m.Header.PeerID = Version
+	m.Header.PID = pid
+	m.Data = m.Data[:0]
+	m.File = nil
+	m.rpos = 0
+}
+
+// Len returns the size of the message on the wire, including the header
+func (m *Message) Len() int {
+	return HeaderSize + len(m.Data)
+}
+
+// Remaining returns the number of payload bytes not yet consumed by the
+// Get helpers.
+func (m *Message) Remaining() int {
+	return len(m.Data) - m.rpos
+}
+
+func (m *Message) GetInt() (int, error) {
+	if m.rpos+4 > len(m.Data) {
+		return 0, io.ErrShortBuffer
+	}
+	i := int32(binary.LittleEndian.Uint32(m.Data[m.rpos:]))
+	m.rpos += 4
+	return int(i), nil
+}
+
+func (m *Message) GetUint32() (uint32, error) {
+	if m.rpos+4 > len(m.Data) {
+		return 0, io.ErrShortBuffer
+	}
+	u := binary.LittleEndian.Uint32(m.Data[m.rpos:])
+	m.rpos += 4
+	return u, nil
+}
+
+func (m *Message) GetSize() (uint64, error) {
+	if m.rpos+8 > len(m.Data) {
+		return 0, io.ErrShortBuffer
+	}
+	u := binary.LittleEndian.Uint64(m.Data[m.rpos:])
+	m.rpos += 8
+	return u, nil
+}
+
+// GetTime decodes a time_t
+func (m *Message) GetTime() (time.Time, error) {
+	if m.rpos+8 > len(m.Data) {
+		return time.Time{}, io.ErrShortBuffer
+	}
+	t := int64(binary.LittleEndian.Uint64(m.Data[m.rpos:]))
+	m.rpos += 8
+	return time.Unix(t, 0), nil
+}
+
+func (m *Message) GetString() (string, error) {
+	o := bytes.IndexByte(m.Data[m.rpos:], 0)
+	if o < 0 {
+		return "", errors.New("imsg: string not NULL-terminated")
+	}
+
+	s := string(m.Data[m.rpos : m.rpos+o])
+	m.rpos += o + 1
+	return s, nil
+}
+
+// GetData decodes a size prefixed byte slice
+func (m *Message) GetData() ([]byte, error) {
+	s, err := m.GetSize()
+	if err != nil {
+		return nil, err
+	}
+	if s > uint64(len(m.Data)-m.rpos) {
+		return nil, io.ErrShortBuffer
+	}
+
+	b := make([]byte, s)
+	copy(b, m.Data[m.rpos:])
+	m.rpos += int(s)
+	return b, nil
+}
+
+func (m *Message) GetID() (uint64, error) {
+	if m.rpos+8 > len(m.Data) {
+		return 0, io.ErrShortBuffer
+	}
+	u := binary.LittleEndian.Uint64(m.Data[m.rpos:])
+	m.rpos += 8
+	return u, nil
+}
+
+// GetEvpID decodes an envelope ID
+func (m *Message) GetEvpID() (uint64, error) {
+	return m.GetID()
+}
+
+// GetMsgID decodes a message ID
+func (m *Message) GetMsgID() (uint32, error) {
+	return m.GetUint32()
+}
+
+func (m *Message) GetSockaddr() (Sockaddr, error) {
+	b, err := m.GetData()
+	if err != nil {
+		return nil, err
+	}
+	return Sockaddr(b), nil
+}
+
+func (m *Message) GetMailaddr() (user, domain string, err error) {
+	if maxLocalPartSize+maxDomainPartSize > len(m.Data[m.rpos:]) {
+		return "", "", io.ErrShortBuffer
+	}
+	user = cString(m.Data[m.rpos : m.rpos+maxLocalPartSize])
+	m.rpos += maxLocalPartSize
+	domain = cString(m.Data[m.rpos : m.rpos+maxDomainPartSize])
+	m.rpos += maxDomainPartSize
+	return
+}
+
+// cString returns the string up to the first NUL byte
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Envelope is a struct envelope, serialized by smtpd's envelope_dump_buffer
+type Envelope struct {
+	ID   uint64
+	Data []byte
+}
+
+func (m *Message) GetEnvelope() (evp Envelope, err error) {
+	if evp.ID, err = m.GetEvpID(); err != nil {
+		return
+	}
+	evp.Data, err = m.GetData()
+	return
+}
+
+func (m *Message) GetType(t uint8) error {
+	if m.rpos >= len(m.Data) {
+		return io.ErrShortBuffer
+	}
+
+	b := m.Data[m.rpos]
+	m.rpos++
+	if b != t {
+		return TypeError{t, b}
+	}
+	return nil
+}
+
+// PeekType returns the type of the next field, without consuming it
+func (m *Message) PeekType() (uint8, error) {
+	if m.rpos >= len(m.Data) {
+		return 0, io.ErrShortBuffer
+	}
+	return m.Data[m.rpos], nil
+}
+
+func (m *Message) GetTypeInt() (int, error) {
+	if err := m.GetType(MInt); err != nil {
+		return 0, err
+	}
+	return m.GetInt()
+}
+
+func (m *Message) GetTypeUint32() (uint32, error) {
+	if err := m.GetType(MUint32); err != nil {
+		return 0, err
+	}
+	return m.GetUint32()
+}
+
+func (m *Message) GetTypeSize() (uint64, error) {
+	if err := m.GetType(MSize); err != nil {
+		return 0, err
+	}
+	return m.GetSize()
+}
+
+func (m *Message) GetTypeTime() (time.Time, error) {
+	if err := m.GetType(MTime); err != nil {
+		return time.Time{}, err
+	}
+	return m.GetTime()
+}
+
+func (m *Message) GetTypeString() (string, error) {
+	if err := m.GetType(MString); err != nil {
+		return "", err
+	}
+	return m.GetString()
+}
+
+func (m *Message) GetTypeData() ([]byte, error) {
+	if err := m.GetType(MData); err != nil {
+		return nil, err
+	}
+	return m.GetData()
+}
+
+func (m *Message) GetTypeID() (uint64, error) {
+	if err := m.GetType(MID); err != nil {
+		return 0, err
+	}
+	return m.GetID()
+}
+
+func (m *Message) GetTypeEvpID() (uint64, error) {
+	if err := m.GetType(MEvpID); err != nil {
+		return 0, err
+	}
+	return m.GetEvpID()
+}
+
+func (m *Message) GetTypeMsgID() (uint32, error) {
+	if err := m.GetType(MMsgID); err != nil {
+		return 0, err
+	}
+	return m.GetMsgID()
+}
+
+func (m *Message) GetTypeSockaddr() (Sockaddr, error) {
+	if err := m.GetType(MSockaddr); err != nil {
+		return nil, err
+	}
+	return m.GetSockaddr()
+}
+
+func (m *Message) GetTypeMailaddr() (user, domain string, err error) {
+	if err = m.GetType(MMailaddr); err != nil {
+		return
+	}
+	return m.GetMailaddr()
+}
+
+// GetTypeEnvelope decodes an envelope, which smtpd sends as a M_EVPID
+// followed by the M_ENVELOPE dump.
+func (m *Message) GetTypeEnvelope() (evp Envelope, err error) {
+	if evp.ID, err = m.GetTypeEvpID(); err != nil {
+		return
+	}
+	if err = m.GetType(MEnvelope); err != nil {
+		return
+	}
+	evp.Data, err = m.GetData()
+	return
+}
+
+func (m *Message) PutInt(v int) {
+	m.Data = binary.LittleEndian.AppendUint32(m.Data, uint32(v))
+}
+
+func (m *Message) PutUint32(v uint32) {
+	m.Data = binary.LittleEndian.AppendUint32(m.Data, v)
+}
+
+func (m *Message) PutSize(v uint64) {
+	m.Data = binary.LittleEndian.AppendUint64(m.Data, v)
+}
+
+// PutTime encodes a time_t
+func (m *Message) PutTime(t time.Time) {
+	m.Data = binary.LittleEndian.AppendUint64(m.Data, uint64(t.Unix()))
+}
+
+func (m *Message) PutString(s string) {
+	m.Data = append(append(m.Data, s...), 0)
+}
+
+// PutData encodes a size prefixed byte slice
+func (m *Message) PutData(b []byte) {
+	m.PutSize(uint64(len(b)))
+	m.Data = append(m.Data, b...)
+}
+
+func (m *Message) PutID(id uint64) {
+	m.Data = binary.LittleEndian.AppendUint64(m.Data, id)
+}
+
+// PutEvpID encodes an envelope ID
+func (m *Message) PutEvpID(id uint64) {
+	m.PutID(id)
+}
+
+// PutMsgID encodes a message ID
+func (m *Message) PutMsgID(id uint32) {
+	m.PutUint32(id)
+}
+
+func (m *Message) PutSockaddr(sa Sockaddr) {
+	m.PutData(sa)
+}
+
+// PutMailaddr encodes a struct mailaddr, parts that do not fit are truncated
+func (m *Message) PutMailaddr(user, domain string) {
+	var b [maxLocalPartSize + maxDomainPartSize]byte
+	copy(b[:maxLocalPartSize-1], user)
+	copy(b[maxLocalPartSize:maxLocalPartSize+maxDomainPartSize-1], domain)
+	m.Data = append(m.Data, b[:]...)
+}
+
+func (m *Message) PutEnvelope(evp Envelope) {
+	m.PutEvpID(evp.ID)
+	m.PutData(evp.Data)
+}
+
+func (m *Message) PutType(t uint8) {
+	m.Data = append(m.Data, t)
+}
+
+func (m *Message) PutTypeInt(v int) {
+	m.PutType(MInt)
+	m.PutInt(v)
+}
+
+func (m *Message) PutTypeUint32(v uint32) {
+	m.PutType(MUint32)
+	m.PutUint32(v)
+}
+
+func (m *Message) PutTypeSize(v uint64) {
+	m.PutType(MSize)
+	m.PutSize(v)
+}
+
+func (m *Message) PutTypeTime(t time.Time) {
+	m.PutType(MTime)
+	m.PutTime(t)
+}
+
+func (m *Message) PutTypeString(s string) {
+	m.PutType(MString)
+	m.PutString(s)
+}
+
+func (m *Message) PutTypeData(b []byte) {
+	m.PutType(MData)
+	m.PutData(b)
+}
+
+func (m *Message) PutTypeID(id uint64) {
+	m.PutType(MID)
+	m.PutID(id)
+}
+
+func (m *Message) PutTypeEvpID(id uint64) {
+	m.PutType(MEvpID)
+	m.PutEvpID(id)
+}
+
+func (m *Message) PutTypeMsgID(id uint32) {
+	m.PutType(MMsgID)
+	m.PutMsgID(id)
+}
+
+func (m *Message) PutTypeSockaddr(sa Sockaddr) {
+	m.PutType(MSockaddr)
+	m.PutSockaddr(sa)
+}
+
+func (m *Message) PutTypeMailaddr(user, domain string) {
+	m.PutType(MMailaddr)
+	m.PutMailaddr(user, domain)
+}
+
+// PutTypeEnvelope encodes an envelope like m_add_envelope, as a M_EVPID
+// followed by the M_ENVELOPE dump.
+func (m *Message) PutTypeEnvelope(evp Envelope) {
+	m.PutTypeEvpID(evp.ID)
+	m.PutType(MEnvelope)
+	m.PutData(evp.Data)
+}
@@ -0,0 +1,495 @@
+package imsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func testFrame(t *testing.T, typ uint32, data string) []byte {
+	t.Helper()
+
+	m := NewMessage(typ)
+	m.Data = append(m.Data, data...)
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testStream(t *testing.T) ([]byte, []string) {
+	t.Helper()
+
+	var (
+		stream []byte
+		data   = []string{"hello", "", "world", string(make([]byte, 4096))}
+	)
+	for i, d := range data {
+		stream = append(stream, testFrame(t, uint32(i), d)...)
+	}
+	return stream, data
+}
+
+func testReadAll(t *testing.T, r io.Reader, want []string) {
+	t.Helper()
+
+	var (
+		d = NewDecoder(r)
+		m = new(Message)
+	)
+	for i, w := range want {
+		if err := d.Decode(m); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if m.Header.Type != uint32(i) {
+			t.Fatalf("frame %d: expected type %d, got %d", i, i, m.Header.Type)
+		}
+		if string(m.Data) != w {
+			t.Fatalf("frame %d: expected %q, got %q", i, w, m.Data)
+		}
+	}
+	if err := d.Decode(m); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestDecoderOneByte(t *testing.T) {
+	stream, want := testStream(t)
+	testReadAll(t, iotest.OneByteReader(bytes.NewReader(stream)), want)
+}
+
+func TestDecoderCoalesced(t *testing.T) {
+	stream, want := testStream(t)
+	testReadAll(t, bytes.NewReader(stream), want)
+}
+
+func TestDecoderDataErr(t *testing.T) {
+	stream, want := testStream(t)
+	testReadAll(t, iotest.DataErrReader(bytes.NewReader(stream)), want)
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	stream, _ := testStream(t)
+	r := iotest.OneByteReader(bytes.NewReader(stream[:len(stream)-1]))
+
+	var (
+		d   = NewDecoder(r)
+		m   = new(Message)
+		err error
+	)
+	for err == nil {
+		err = d.Decode(m)
+	}
+	if err != ErrTruncated {
+		t.Fatalf("expected %v, got %v", ErrTruncated, err)
+	}
+}
+
+// againReader returns EAGAIN before every successful read
+type againReader struct {
+	r     io.Reader
+	again bool
+}
+
+func (r *againReader) Read(p []byte) (int, error) {
+	if r.again = !r.again; r.again {
+		return 0, syscall.EAGAIN
+	}
+	return r.r.Read(p)
+}
+
+func TestDecoderAgain(t *testing.T) {
+	stream, want := testStream(t)
+	r := &againReader{r: iotest.OneByteReader(bytes.NewReader(stream))}
+
+	var (
+		d = NewDecoder(r)
+		m = new(Message)
+	)
+	for i, w := range want {
+		var err error
+		for {
+			if err = d.Decode(m); err != ErrAgain {
+				break
+			}
+		}
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if string(m.Data) != w {
+			t.Fatalf("frame %d: expected %q, got %q", i, w, m.Data)
+		}
+	}
+}
+
+func testSocketpair(t *testing.T) (a, b *net.UnixConn) {
+	t.Helper()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := func(fd int) *net.UnixConn {
+		f := os.NewFile(uintptr(fd), "")
+		defer f.Close()
+		c, err := net.FileConn(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.(*net.UnixConn)
+	}
+	a, b = conn(fds[0]), conn(fds[1])
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return
+}
+
+func TestFilePassing(t *testing.T) {
+	a, b := testSocketpair(t)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+
+	enc := NewEncoder(a)
+	out := NewMessage(1)
+	out.PutTypeID(42)
+	out.File = pr
+	if err = enc.Encode(out); err != nil {
+		t.Fatal(err)
+	}
+	if out.File != nil {
+		t.Fatal("expected file to be released after sending")
+	}
+
+	// A frame without descriptor following the one with
+	out.Reset()
+	out.Header.Type = 2
+	if err = enc.Encode(out); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		dec = NewDecoder(b)
+		in  = new(Message)
+	)
+	if err = dec.Decode(in); err != nil {
+		t.Fatal(err)
+	}
+	if in.Header.Flags&FlagHasFD == 0 || in.File == nil {
+		t.Fatalf("expected file descriptor, got flags %#x", in.Header.Flags)
+	}
+	defer in.File.Close()
+
+	if _, err = pw.WriteString("test"); err != nil {
+		t.Fatal(err)
+	}
+	var buf [4]byte
+	if _, err = io.ReadFull(in.File, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:]) != "test" {
+		t.Fatalf("expected %q, got %q", "test", buf)
+	}
+
+	if err = dec.Decode(in); err != nil {
+		t.Fatal(err)
+	}
+	if in.Header.Type != 2 || in.File != nil {
+		t.Fatalf("unexpected frame %+v with file %v", in.Header, in.File)
+	}
+}
+
+// shortWriter passes descriptors, but takes at most max bytes with them
+type shortWriter struct {
+	bytes.Buffer
+	max    int
+	rights int
+}
+
+func (w *shortWriter) WriteMsgUnix(b, oob []byte, addr *net.UnixAddr) (int, int, error) {
+	if len(oob) > 0 {
+		w.rights++
+	}
+	if len(b) > w.max {
+		b = b[:w.max]
+	}
+	n, _ := w.Write(b)
+	return n, len(oob), nil
+}
+
+func TestEncoderShortWrite(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pw.Close()
+
+	m := NewMessage(1)
+	m.PutTypeString("a frame longer than the first chunk")
+	m.File = pr
+
+	w := &shortWriter{max: 3}
+	if err = NewEncoder(w).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	if w.rights != 1 {
+		t.Fatalf("expected descriptor to be sent once, got %d", w.rights)
+	}
+
+	want := m.Header.appendTo(nil)
+	want = append(want, m.Data...)
+	if !bytes.Equal(w.Bytes(), want) {
+		t.Fatalf("expected %q, got %q", want, w.Bytes())
+	}
+}
+
+func TestEncoderFileUnsupported(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	m := NewMessage(1)
+	m.File = pr
+	if err = NewEncoder(new(bytes.Buffer)).Encode(m); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestMessageTypedRoundTrip(t *testing.T) {
+	var (
+		now = time.Unix(1500000000, 0)
+		sa  = Sockaddr{2, 0, 0, 25, 127, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+		evp = Envelope{ID: 0x1234567890abcdef, Data: []byte("version: 2\nhelo: test\n\x00")}
+	)
+
+	out := NewMessage(1)
+	out.PutTypeInt(-1)
+	out.PutTypeUint32(0xdeadbeef)
+	out.PutTypeSize(1 << 40)
+	out.PutTypeTime(now)
+	out.PutTypeString("hello")
+	out.PutTypeString("")
+	out.PutTypeData([]byte{0, 1, 2, 3})
+	out.PutTypeID(42)
+	out.PutTypeEvpID(evp.ID)
+	out.PutTypeMsgID(0x12345678)
+	out.PutTypeSockaddr(sa)
+	out.PutTypeMailaddr("user", "example.org")
+	out.PutTypeEnvelope(evp)
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(out); err != nil {
+		t.Fatal(err)
+	}
+	m := new(Message)
+	if err := NewDecoder(&buf).Decode(m); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, got, want interface{}, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+
+	i, err := m.GetTypeInt()
+	check("int", i, -1, err)
+	u, err := m.GetTypeUint32()
+	check("uint32", u, uint32(0xdeadbeef), err)
+	z, err := m.GetTypeSize()
+	check("size", z, uint64(1<<40), err)
+	tm, err := m.GetTypeTime()
+	check("time", tm, now, err)
+	s, err := m.GetTypeString()
+	check("string", s, "hello", err)
+	s, err = m.GetTypeString()
+	check("empty string", s, "", err)
+	b, err := m.GetTypeData()
+	check("data", b, []byte{0, 1, 2, 3}, err)
+	id, err := m.GetTypeID()
+	check("id", id, uint64(42), err)
+	id, err = m.GetTypeEvpID()
+	check("evpid", id, evp.ID, err)
+	u, err = m.GetTypeMsgID()
+	check("msgid", u, uint32(0x12345678), err)
+	a, err := m.GetTypeSockaddr()
+	check("sockaddr", a, sa, err)
+	user, domain, err := m.GetTypeMailaddr()
+	check("mailaddr", user+"@"+domain, "user@example.org", err)
+	e, err := m.GetTypeEnvelope()
+	check("envelope", e, evp, err)
+
+	if n := m.Remaining(); n != 0 {
+		t.Fatalf("expected all bytes consumed, %d remain", n)
+	}
+	if _, err = m.GetTypeInt(); err != io.ErrShortBuffer {
+		t.Fatalf("expected %v, got %v", io.ErrShortBuffer, err)
+	}
+}
+
+func TestMessageTypeMismatch(t *testing.T) {
+	m := NewMessage(1)
+	m.PutTypeString("test")
+
+	_, err := m.GetTypeInt()
+	if _, ok := err.(TypeError); !ok {
+		t.Fatalf("expected type error, got %v", err)
+	}
+}
+
+func TestEncoderTooLarge(t *testing.T) {
+	var (
+		buf bytes.Buffer
+		m   = NewMessage(1)
+	)
+	m.PutTypeData(make([]byte, MaxSize))
+	if err := NewEncoder(&buf).Encode(m); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrTooLarge, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing written, got %d bytes", buf.Len())
+	}
+
+	m.Reset()
+	m.PutData(make([]byte, MaxSize-HeaderSize-8))
+	if err := NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != MaxSize {
+		t.Fatalf("expected %d bytes written, got %d", MaxSize, buf.Len())
+	}
+}
+
+func TestDecoderInvalidLengths(t *testing.T) {
+	for _, size := range []uint16{0, HeaderSize - 1, MaxSize + 1, 0xffff} {
+		frame := testFrame(t, 1, "")
+		binary.LittleEndian.PutUint16(frame[4:], size)
+		frame = append(frame, make([]byte, 0x10000)...)
+
+		err := NewDecoder(bytes.NewReader(frame)).Decode(new(Message))
+		if !errors.Is(err, ErrInvalidLength) {
+			t.Errorf("length %d: expected %v, got %v", size, ErrInvalidLength, err)
+		}
+	}
+}
+
+// loopReader returns the same frame forever
+type loopReader struct {
+	frame []byte
+	pos   int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.frame[r.pos:])
+	r.pos = (r.pos + n) % len(r.frame)
+	return n, nil
+}
+
+func testQuery() *Message {
+	m := NewMessage(2)
+	m.PutTypeID(0x1234)
+	m.PutTypeID(0x5678)
+	m.PutTypeInt(1)
+	m.PutTypeString("mx.example.org")
+	return m
+}
+
+func TestCodecAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("buffers are not reused reliably with the race detector")
+	}
+
+	var (
+		buf bytes.Buffer
+		enc = NewEncoder(&buf)
+		m   = testQuery()
+	)
+	if err := enc.Encode(m); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		dec = NewDecoder(&loopReader{frame: buf.Bytes()})
+		in  = new(Message)
+	)
+	if n := testing.AllocsPerRun(100, func() {
+		if err := dec.Decode(in); err != nil {
+			t.Fatal(err)
+		}
+	}); n != 0 {
+		t.Errorf("Decode: expected no allocations, got %.1f", n)
+	}
+
+	enc = NewEncoder(io.Discard)
+	if n := testing.AllocsPerRun(100, func() {
+		out := AcquireMessage(2)
+		out.PutTypeID(0x1234)
+		out.PutTypeInt(0)
+		if err := enc.Encode(out); err != nil {
+			t.Fatal(err)
+		}
+		ReleaseMessage(out)
+	}); n != 0 {
+		t.Errorf("Encode: expected no allocations, got %.1f", n)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(testQuery()); err != nil {
+		b.Fatal(err)
+	}
+
+	var (
+		dec = NewDecoder(&loopReader{frame: buf.Bytes()})
+		m   = new(Message)
+	)
+	b.SetBytes(int64(buf.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := dec.Decode(m); err != nil {
+			b.Fatal(err)
+		}
+		m.GetTypeID()
+		m.GetTypeID()
+		m.GetTypeInt()
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	var (
+		enc = NewEncoder(io.Discard)
+		m   = testQuery()
+	)
+	b.SetBytes(int64(m.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
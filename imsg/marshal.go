@@ -0,0 +1,445 @@
+package imsg
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Marshaler is implemented by types that encode themselves, such as
+// collections prefixed with their size.
+type Marshaler interface {
+	MarshalMproc(m *Message, typed bool) error
+}
+
+// Unmarshaler is implemented by types that decode themselves.
+type Unmarshaler interface {
+	UnmarshalMproc(m *Message, typed bool) error
+}
+
+// Mailaddr is a struct mailaddr
+type Mailaddr struct {
+	User, Domain string
+}
+
+func (addr Mailaddr) String() string {
+	if addr.Domain == "" {
+		return addr.User
+	}
+	return addr.User + "@" + addr.Domain
+}
+
+// Marshal appends the fields of the struct pointed to by v to the message,
+// each prefixed with its mproc type.
+//
+// Fields are encoded in the order of declaration, according to the name in
+// their mproc struct tag:
+//
+//	int       any integer, as int
+//	uint32    any integer, as uint32_t
+//	size      any integer, as size_t
+//	time      time.Time, as time_t
+//	string    string
+//	data      []byte, prefixed with its size
+//	id        any integer, as uint64_t
+//	evpid     any integer, as uint64_t
+//	msgid     any integer, as uint32_t
+//	sockaddr  Sockaddr or net.Addr
+//	mailaddr  Mailaddr
+//	envelope  Envelope
+//
+// Integers that do not fit the mproc type, such as a negative size or an
+// int64 beyond the range of int, fail to encode and decode rather than
+// being truncated.
+//
+// The omitempty option skips a zero value, it should only be used for the
+// trailing fields of a message. Fields without tag, or with tag "-", are
+// ignored. Fields implementing Marshaler encode themselves, and those
+// implementing Unmarshaler decode themselves; the name in their tag is only
+// used for the other direction, if the type does not implement both.
+func Marshal(m *Message, v interface{}) error {
+	return marshal(m, v, true)
+}
+
+// MarshalUntyped is like Marshal, without the type prefixes, as used by the
+// table API.
+func MarshalUntyped(m *Message, v interface{}) error {
+	return marshal(m, v, false)
+}
+
+// Unmarshal decodes the message into the struct pointed to by v, the
+// fields are described like for Marshal. With omitempty, a field is left
+// untouched if the message has no more data.
+func Unmarshal(m *Message, v interface{}) error {
+	return unmarshal(m, v, true)
+}
+
+// UnmarshalUntyped is like Unmarshal, for messages without type prefixes.
+func UnmarshalUntyped(m *Message, v interface{}) error {
+	return unmarshal(m, v, false)
+}
+
+// field describes how a struct field is (un)marshalled
+type field struct {
+	index     int
+	name      string
+	kind      uint8
+	omitempty bool
+
+	// marshaler and unmarshaler are set if the field encodes or decodes
+	// itself
+	marshaler, unmarshaler bool
+}
+
+var (
+	fieldsCache sync.Map // map[reflect.Type][]field
+
+	mprocTypeByTag = map[string]uint8{
+		"int":      MInt,
+		"uint32":   MUint32,
+		"size":     MSize,
+		"time":     MTime,
+		"string":   MString,
+		"data":     MData,
+		"id":       MID,
+		"evpid":    MEvpID,
+		"msgid":    MMsgID,
+		"sockaddr": MSockaddr,
+		"mailaddr": MMailaddr,
+		"envelope": MEnvelope,
+	}
+
+	marshalerType   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	netAddrType     = reflect.TypeOf((*net.Addr)(nil)).Elem()
+	timeType        = reflect.TypeOf(time.Time{})
+)
+
+func fieldsOf(t reflect.Type) ([]field, error) {
+	if cached, ok := fieldsCache.Load(t); ok {
+		return cached.([]field), nil
+	}
+
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("mproc")
+		if !ok || tag == "-" {
+			continue
+		}
+		if sf.PkgPath != "" {
+			return nil, fmt.Errorf("mproc: field %s of %s is not exported", sf.Name, t)
+		}
+
+		f := field{index: i, name: sf.Name}
+		opts := strings.Split(tag, ",")
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "omitempty":
+				f.omitempty = true
+			default:
+				return nil, fmt.Errorf("mproc: field %s of %s has unknown option %q", sf.Name, t, opt)
+			}
+		}
+
+		pt := reflect.PointerTo(sf.Type)
+		f.marshaler = pt.Implements(marshalerType)
+		f.unmarshaler = pt.Implements(unmarshalerType)
+		if f.marshaler && f.unmarshaler {
+			// The tag is not used
+		} else if f.kind, ok = mprocTypeByTag[opts[0]]; !ok {
+			return nil, fmt.Errorf("mproc: field %s of %s has unknown type %q", sf.Name, t, opts[0])
+		} else if err := checkKind(f.kind, sf.Type); err != nil {
+			return nil, fmt.Errorf("mproc: field %s of %s: %v", sf.Name, t, err)
+		}
+		fields = append(fields, f)
+	}
+
+	fieldsCache.Store(t, fields)
+	return fields, nil
+}
+
+func checkKind(kind uint8, t reflect.Type) error {
+	var ok bool
+	switch kind {
+	case MInt, MUint32, MSize, MID, MEvpID, MMsgID:
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			ok = true
+		}
+	case MTime:
+		ok = t == timeType
+	case MString:
+		ok = t.Kind() == reflect.String
+	case MData:
+		ok = t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+	case MSockaddr:
+		ok = t == reflect.TypeOf(Sockaddr(nil)) || t == netAddrType
+	case MMailaddr:
+		ok = t == reflect.TypeOf(Mailaddr{})
+	case MEnvelope:
+		ok = t == reflect.TypeOf(Envelope{})
+	}
+	if !ok {
+		return fmt.Errorf("%s can not be stored in %s", TypeName(kind), t)
+	}
+	return nil
+}
+
+func structOf(v interface{}) (reflect.Value, []field, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, nil, fmt.Errorf("mproc: expected pointer to struct, got %T", v)
+	}
+	rv = rv.Elem()
+	fields, err := fieldsOf(rv.Type())
+	return rv, fields, err
+}
+
+func marshal(m *Message, v interface{}, typed bool) error {
+	rv, fields, err := structOf(v)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		fv := rv.Field(f.index)
+		if f.omitempty && fv.IsZero() {
+			continue
+		}
+		if f.marshaler {
+			if err = fv.Addr().Interface().(Marshaler).MarshalMproc(m, typed); err != nil {
+				return err
+			}
+			continue
+		}
+		if typed && f.kind == MEnvelope {
+			// The envelope ID has its own type
+			m.PutTypeEnvelope(fv.Interface().(Envelope))
+			continue
+		} else if typed {
+			m.PutType(f.kind)
+		}
+		if err = putValue(m, f.kind, fv); err != nil {
+			return fmt.Errorf("mproc: field %s: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+func putValue(m *Message, kind uint8, fv reflect.Value) error {
+	switch kind {
+	case MInt:
+		i, err := intField(fv, kind, math.MinInt32, math.MaxInt32)
+		if err != nil {
+			return err
+		}
+		m.PutInt(int(i))
+	case MUint32, MMsgID:
+		u, err := uintField(fv, kind, math.MaxUint32)
+		if err != nil {
+			return err
+		}
+		m.PutUint32(uint32(u))
+	case MSize, MID, MEvpID:
+		u, err := uintField(fv, kind, math.MaxUint64)
+		if err != nil {
+			return err
+		}
+		m.PutSize(u)
+	case MTime:
+		m.PutTime(fv.Interface().(time.Time))
+	case MString:
+		m.PutString(fv.String())
+	case MData:
+		m.PutData(fv.Bytes())
+	case MSockaddr:
+		sa, ok := fv.Interface().(Sockaddr)
+		if !ok {
+			if fv.IsNil() {
+				return errors.New("nil address")
+			}
+			var err error
+			if sa, err = NewSockaddr(fv.Interface().(net.Addr), NativeLayout); err != nil {
+				return err
+			}
+		}
+		m.PutSockaddr(sa)
+	case MMailaddr:
+		addr := fv.Interface().(Mailaddr)
+		m.PutMailaddr(addr.User, addr.Domain)
+	case MEnvelope:
+		m.PutEnvelope(fv.Interface().(Envelope))
+	}
+	return nil
+}
+
+// intField returns the value of an integer field, if it is within the range
+// of the mproc type kind
+func intField(fv reflect.Value, kind uint8, min, max int64) (int64, error) {
+	switch fv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := fv.Uint()
+		if u > uint64(max) {
+			return 0, fmt.Errorf("%d overflows %s", u, TypeName(kind))
+		}
+		return int64(u), nil
+	default:
+		i := fv.Int()
+		if i < min || i > max {
+			return 0, fmt.Errorf("%d overflows %s", i, TypeName(kind))
+		}
+		return i, nil
+	}
+}
+
+// uintField returns the value of an integer field, if it is within the range
+// of the unsigned mproc type kind
+func uintField(fv reflect.Value, kind uint8, max uint64) (uint64, error) {
+	switch fv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := fv.Uint()
+		if u > max {
+			return 0, fmt.Errorf("%d overflows %s", u, TypeName(kind))
+		}
+		return u, nil
+	default:
+		i := fv.Int()
+		if i < 0 || uint64(i) > max {
+			return 0, fmt.Errorf("%d overflows %s", i, TypeName(kind))
+		}
+		return uint64(i), nil
+	}
+}
+
+func unmarshal(m *Message, v interface{}, typed bool) error {
+	rv, fields, err := structOf(v)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		if f.omitempty && m.Remaining() == 0 {
+			continue
+		}
+		fv := rv.Field(f.index)
+		if f.unmarshaler {
+			if err = fv.Addr().Interface().(Unmarshaler).UnmarshalMproc(m, typed); err != nil {
+				return err
+			}
+			continue
+		}
+		if typed && f.kind == MEnvelope {
+			// The envelope ID has its own type
+			var evp Envelope
+			if evp, err = m.GetTypeEnvelope(); err != nil {
+				return fmt.Errorf("mproc: field %s: %w", f.name, err)
+			}
+			fv.Set(reflect.ValueOf(evp))
+			continue
+		} else if typed {
+			if err = m.GetType(f.kind); err != nil {
+				return fmt.Errorf("mproc: field %s: %w", f.name, err)
+			}
+		}
+		if err = getValue(m, f.kind, fv); err != nil {
+			return fmt.Errorf("mproc: field %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+func getValue(m *Message, kind uint8, fv reflect.Value) (err error) {
+	switch kind {
+	case MInt:
+		var i int
+		if i, err = m.GetInt(); err == nil {
+			err = setInt(fv, int64(i))
+		}
+	case MUint32, MMsgID:
+		var u uint32
+		if u, err = m.GetUint32(); err == nil {
+			err = setUint(fv, uint64(u))
+		}
+	case MSize, MID, MEvpID:
+		var u uint64
+		if u, err = m.GetSize(); err == nil {
+			err = setUint(fv, u)
+		}
+	case MTime:
+		var t time.Time
+		if t, err = m.GetTime(); err == nil {
+			fv.Set(reflect.ValueOf(t))
+		}
+	case MString:
+		var s string
+		if s, err = m.GetString(); err == nil {
+			fv.SetString(s)
+		}
+	case MData:
+		var b []byte
+		if b, err = m.GetData(); err == nil {
+			fv.SetBytes(b)
+		}
+	case MSockaddr:
+		var sa Sockaddr
+		if sa, err = m.GetSockaddr(); err == nil {
+			if fv.Type() == netAddrType {
+				fv.Set(reflect.ValueOf(sa.Addr()))
+			} else {
+				fv.Set(reflect.ValueOf(sa))
+			}
+		}
+	case MMailaddr:
+		var addr Mailaddr
+		if addr.User, addr.Domain, err = m.GetMailaddr(); err == nil {
+			fv.Set(reflect.ValueOf(addr))
+		}
+	case MEnvelope:
+		var evp Envelope
+		if evp, err = m.GetEnvelope(); err == nil {
+			fv.Set(reflect.ValueOf(evp))
+		}
+	}
+	return
+}
+
+// setInt stores a signed integer in an integer field, if it fits
+func setInt(fv reflect.Value, i int64) error {
+	switch fv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i < 0 || fv.OverflowUint(uint64(i)) {
+			return fmt.Errorf("%d overflows %s", i, fv.Type())
+		}
+		fv.SetUint(uint64(i))
+	default:
+		if fv.OverflowInt(i) {
+			return fmt.Errorf("%d overflows %s", i, fv.Type())
+		}
+		fv.SetInt(i)
+	}
+	return nil
+}
+
+// setUint stores an unsigned integer in an integer field, if it fits
+func setUint(fv reflect.Value, u uint64) error {
+	switch fv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if fv.OverflowUint(u) {
+			return fmt.Errorf("%d overflows %s", u, fv.Type())
+		}
+		fv.SetUint(u)
+	default:
+		if u > math.MaxInt64 || fv.OverflowInt(int64(u)) {
+			return fmt.Errorf("%d overflows %s", u, fv.Type())
+		}
+		fv.SetInt(int64(u))
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package imsg
+
+import (
+	"errors"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAllTypes struct {
+	Int      int       `mproc:"int"`
+	Uint32   uint32    `mproc:"uint32"`
+	Size     uint64    `mproc:"size"`
+	Time     time.Time `mproc:"time"`
+	String   string    `mproc:"string"`
+	Data     []byte    `mproc:"data"`
+	ID       uint64    `mproc:"id"`
+	EvpID    uint64    `mproc:"evpid"`
+	MsgID    uint32    `mproc:"msgid"`
+	Sockaddr Sockaddr  `mproc:"sockaddr"`
+	Addr     net.Addr  `mproc:"sockaddr"`
+	Mailaddr Mailaddr  `mproc:"mailaddr"`
+	Envelope Envelope  `mproc:"envelope"`
+	Pairs    testPairs `mproc:"pairs"`
+	Ignored  string    `mproc:"-"`
+	Untagged int
+	Line     string `mproc:"string,omitempty"`
+}
+
+// testPairs encodes like the table API params
+type testPairs map[string]string
+
+func (p testPairs) MarshalMproc(m *Message, typed bool) error {
+	if typed {
+		m.PutTypeSize(uint64(len(p)))
+	} else {
+		m.PutSize(uint64(len(p)))
+	}
+	for k, v := range p {
+		m.PutString(k)
+		m.PutString(v)
+	}
+	return nil
+}
+
+func (p *testPairs) UnmarshalMproc(m *Message, typed bool) (err error) {
+	var n uint64
+	if typed {
+		n, err = m.GetTypeSize()
+	} else {
+		n, err = m.GetSize()
+	}
+	if err != nil {
+		return
+	}
+	*p = make(testPairs, n)
+	for ; n > 0; n-- {
+		var k, v string
+		if k, err = m.GetString(); err != nil {
+			return
+		}
+		if v, err = m.GetString(); err != nil {
+			return
+		}
+		(*p)[k] = v
+	}
+	return
+}
+
+func testAllTypesValue() testAllTypes {
+	return testAllTypes{
+		Int:      -42,
+		Uint32:   42,
+		Size:     1 << 33,
+		Time:     time.Unix(1500000000, 0),
+		String:   "hello",
+		Data:     []byte{1, 2, 3},
+		ID:       0x1122334455667788,
+		EvpID:    0x8877665544332211,
+		MsgID:    0x88776655,
+		Sockaddr: Sockaddr{16, 2, 0, 25, 192, 0, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+		Addr:     &net.TCPAddr{IP: net.IP{192, 0, 2, 2}, Port: 2525},
+		Mailaddr: Mailaddr{"user", "example.org"},
+		Envelope: Envelope{ID: 0x8877665544332211, Data: []byte("version: 2\n")},
+		Pairs:    testPairs{"key": "value"},
+		Line:     "trailer",
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	for _, typed := range []bool{true, false} {
+		var (
+			in  = testAllTypesValue()
+			out testAllTypes
+			m   = NewMessage(1)
+			err error
+		)
+		in.Ignored = "ignored"
+		in.Untagged = 1
+
+		if typed {
+			err = Marshal(m, &in)
+		} else {
+			err = MarshalUntyped(m, &in)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typed {
+			err = Unmarshal(m, &out)
+		} else {
+			err = UnmarshalUntyped(m, &out)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		in.Ignored, in.Untagged = "", 0
+		if !reflect.DeepEqual(in, out) {
+			t.Fatalf("typed=%t: expected\n%+v, got\n%+v", typed, in, out)
+		}
+		if n := m.Remaining(); n != 0 {
+			t.Fatalf("typed=%t: %d bytes remaining", typed, n)
+		}
+	}
+}
+
+func TestMarshalMatchesHelpers(t *testing.T) {
+	var (
+		in = testAllTypesValue()
+		a  = NewMessage(1)
+		b  = NewMessage(1)
+	)
+	in.Pairs = nil
+	in.Line = ""
+	if err := Marshal(a, &in); err != nil {
+		t.Fatal(err)
+	}
+
+	sa, _ := NewSockaddr(in.Addr, NativeLayout)
+	b.PutTypeInt(in.Int)
+	b.PutTypeUint32(in.Uint32)
+	b.PutTypeSize(in.Size)
+	b.PutTypeTime(in.Time)
+	b.PutTypeString(in.String)
+	b.PutTypeData(in.Data)
+	b.PutTypeID(in.ID)
+	b.PutTypeEvpID(in.EvpID)
+	b.PutTypeMsgID(in.MsgID)
+	b.PutTypeSockaddr(in.Sockaddr)
+	b.PutTypeSockaddr(sa)
+	b.PutTypeMailaddr(in.Mailaddr.User, in.Mailaddr.Domain)
+	b.PutTypeEnvelope(in.Envelope)
+	b.PutTypeSize(0)
+
+	if !reflect.DeepEqual(a.Data, b.Data) {
+		t.Fatalf("expected\n%q, got\n%q", b.Data, a.Data)
+	}
+}
+
+func TestUnmarshalOmitEmpty(t *testing.T) {
+	var v struct {
+		Status int    `mproc:"int"`
+		Line   string `mproc:"string,omitempty"`
+	}
+
+	m := NewMessage(1)
+	m.PutTypeInt(1)
+	if err := Unmarshal(m, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Status != 1 || v.Line != "" {
+		t.Fatalf("unexpected %+v", v)
+	}
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	var v struct {
+		ID uint64 `mproc:"id"`
+	}
+
+	m := NewMessage(1)
+	m.PutTypeInt(1)
+	var terr TypeError
+	if err := Unmarshal(m, &v); !errors.As(err, &terr) {
+		t.Fatalf("expected type error, got %v", err)
+	}
+}
+
+// testUpper decodes itself in upper case, it is encoded as a string
+type testUpper string
+
+func (u *testUpper) UnmarshalMproc(m *Message, typed bool) error {
+	var (
+		s   string
+		err error
+	)
+	if typed {
+		s, err = m.GetTypeString()
+	} else {
+		s, err = m.GetString()
+	}
+	*u = testUpper(strings.ToUpper(s))
+	return err
+}
+
+func TestMarshalUnmarshaler(t *testing.T) {
+	v := struct {
+		Value testUpper `mproc:"string"`
+	}{"hello"}
+
+	m := NewMessage(1)
+	if err := Marshal(m, &v); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal(m, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "HELLO" {
+		t.Fatalf("expected %q, got %q", "HELLO", v.Value)
+	}
+
+	// Without a type to encode it as
+	invalid := &struct {
+		Value testUpper `mproc:"pairs"`
+	}{"hello"}
+	if err := Marshal(NewMessage(1), invalid); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestUnmarshalOverflow(t *testing.T) {
+	for _, test := range []struct {
+		put   func(m *Message)
+		v     interface{}
+		valid bool
+	}{
+		{func(m *Message) { m.PutTypeUint32(255) }, &struct {
+			V uint8 `mproc:"uint32"`
+		}{}, true},
+		{func(m *Message) { m.PutTypeUint32(256) }, &struct {
+			V uint8 `mproc:"uint32"`
+		}{}, false},
+		{func(m *Message) { m.PutTypeInt(-1) }, &struct {
+			V uint64 `mproc:"int"`
+		}{}, false},
+		{func(m *Message) { m.PutTypeInt(-128) }, &struct {
+			V int8 `mproc:"int"`
+		}{}, true},
+		{func(m *Message) { m.PutTypeSize(1 << 63) }, &struct {
+			V int64 `mproc:"size"`
+		}{}, false},
+		{func(m *Message) { m.PutTypeID(1 << 63) }, &struct {
+			V uint64 `mproc:"id"`
+		}{}, true},
+	} {
+		m := NewMessage(1)
+		test.put(m)
+		if err := Unmarshal(m, test.v); (err == nil) != test.valid {
+			t.Errorf("%T: expected valid=%t, got %v", test.v, test.valid, err)
+		}
+	}
+}
+
+func TestMarshalOverflow(t *testing.T) {
+	for _, test := range []struct {
+		v     interface{}
+		valid bool
+	}{
+		{&struct {
+			V int64 `mproc:"int"`
+		}{math.MaxInt32}, true},
+		{&struct {
+			V int64 `mproc:"int"`
+		}{math.MaxInt32 + 1}, false},
+		{&struct {
+			V int64 `mproc:"int"`
+		}{math.MinInt32 - 1}, false},
+		{&struct {
+			V uint64 `mproc:"int"`
+		}{1 << 32}, false},
+		{&struct {
+			V int `mproc:"uint32"`
+		}{-1}, false},
+		{&struct {
+			V uint64 `mproc:"uint32"`
+		}{math.MaxUint32 + 1}, false},
+		{&struct {
+			V int64 `mproc:"msgid"`
+		}{math.MaxUint32}, true},
+		{&struct {
+			V int64 `mproc:"msgid"`
+		}{-1}, false},
+		{&struct {
+			V int `mproc:"size"`
+		}{-1}, false},
+		{&struct {
+			V uint64 `mproc:"id"`
+		}{math.MaxUint64}, true},
+	} {
+		m := NewMessage(1)
+		if err := Marshal(m, test.v); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid=%t, got %v", test.v, test.valid, err)
+		}
+	}
+}
+
+func TestMarshalInvalid(t *testing.T) {
+	tests := []interface{}{
+		struct{}{},
+		&struct {
+			Value string `mproc:"int"`
+		}{},
+		&struct {
+			Value int `mproc:"integer"`
+		}{},
+		&struct {
+			Value int `mproc:"int,required"`
+		}{},
+		&struct {
+			value int `mproc:"int"`
+		}{},
+	}
+	for _, v := range tests {
+		if err := Marshal(NewMessage(1), v); err == nil {
+			t.Errorf("%T: expected error", v)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package imsg
+
+import (
+	"fmt"
+)
+
+// Types of mproc fields
+const (
+	MInt uint8 = iota
+	MUint32
+	MSize
+	MTime
+	MString
+	MData
+	MID
+	MEvpID
+	MMsgID
+	MSockaddr
+	MMailaddr
+	MEnvelope
+)
+
+var mprocTypeName = map[uint8]string{
+	MInt:      "M_INT",
+	MUint32:   "M_UINT32",
+	MSize:     "M_SIZET",
+	MTime:     "M_TIME",
+	MString:   "M_STRING",
+	MData:     "M_DATA",
+	MID:       "M_ID",
+	MEvpID:    "M_EVPID",
+	MMsgID:    "M_MSGID",
+	MSockaddr: "M_SOCKADDR",
+	MMailaddr: "M_MAILADDR",
+	MEnvelope: "M_ENVELOPE",
+}
+
+// TypeName returns the smtpd name of a mproc field type
+func TypeName(t uint8) string {
+	if s, ok := mprocTypeName[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("UNKNOWN %d", t)
+}
+
+// TypeError is returned by the GetType helpers if the field type does not
+// match the expected type.
+type TypeError struct {
+	Want, Got uint8
+}
+
+func (err TypeError) Error() string {
+	return fmt.Sprintf("mproc: expected type %s, got %s",
+		TypeName(err.Want), TypeName(err.Got))
+}
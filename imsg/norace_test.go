@@ -0,0 +1,5 @@
+//go:build !race
+
+package imsg
+
+const raceEnabled = false
@@ -0,0 +1,61 @@
+package imsg
+
+import (
+	"fmt"
+)
+
+// Message types of the filter API
+const (
+	FilterRegister uint32 = iota
+	FilterEvent
+	FilterQuery
+	FilterPipe
+	FilterResponse
+)
+
+var filterTypeName = map[uint32]string{
+	FilterRegister: "IMSG_FILTER_REGISTER",
+	FilterEvent:    "IMSG_FILTER_EVENT",
+	FilterQuery:    "IMSG_FILTER_QUERY",
+	FilterPipe:     "IMSG_FILTER_PIPE",
+	FilterResponse: "IMSG_FILTER_RESPONSE",
+}
+
+// FilterTypeName returns the smtpd name of a filter API message type
+func FilterTypeName(t uint32) string {
+	if s, ok := filterTypeName[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("UNKNOWN %d", t)
+}
+
+// Message types of the table API
+const (
+	TableOK uint32 = iota
+	TableFail
+	TableOpen
+	TableClose
+	TableUpdate
+	TableCheck
+	TableLookup
+	TableFetch
+)
+
+var tableTypeName = map[uint32]string{
+	TableOK:     "PROC_TABLE_OK",
+	TableFail:   "PROC_TABLE_FAIL",
+	TableOpen:   "PROC_TABLE_OPEN",
+	TableClose:  "PROC_TABLE_CLOSE",
+	TableUpdate: "PROC_TABLE_UPDATE",
+	TableCheck:  "PROC_TABLE_CHECK",
+	TableLookup: "PROC_TABLE_LOOKUP",
+	TableFetch:  "PROC_TABLE_FETCH",
+}
+
+// TableTypeName returns the smtpd name of a table API message type
+func TableTypeName(t uint32) string {
+	if s, ok := tableTypeName[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("UNKNOWN %d", t)
+}
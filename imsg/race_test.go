@@ -0,0 +1,7 @@
+//go:build race
+
+package imsg
+
+// raceEnabled is set if the race detector is on, it makes sync.Pool drop
+// items at random
+const raceEnabled = true
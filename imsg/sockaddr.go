@@ -0,0 +1,290 @@
+package imsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// SockaddrLayout is the layout of the struct sockaddr header
+type SockaddrLayout int
+
+// Sockaddr layouts
+const (
+	// LayoutLinux has a 16-bit sa_family in host byte order
+	LayoutLinux SockaddrLayout = iota
+
+	// LayoutBSD has an 8-bit sa_len followed by an 8-bit sa_family
+	LayoutBSD
+)
+
+func (l SockaddrLayout) String() string {
+	switch l {
+	case LayoutLinux:
+		return "linux"
+	case LayoutBSD:
+		return "bsd"
+	default:
+		return fmt.Sprintf("UNKNOWN %d", int(l))
+	}
+}
+
+// NativeLayout is the sockaddr layout used by the local smtpd
+var NativeLayout = nativeLayout()
+
+func nativeLayout() SockaddrLayout {
+	switch runtime.GOOS {
+	case "darwin", "dragonfly", "freebsd", "netbsd", "openbsd":
+		return LayoutBSD
+	default:
+		return LayoutLinux
+	}
+}
+
+// Address families, AF_UNIX and AF_INET are the same everywhere
+const (
+	afUnix = 1
+	afInet = 2
+
+	afInet6Linux   = 10
+	afInet6OpenBSD = 24 // also NetBSD
+	afInet6FreeBSD = 28 // also DragonFly
+	afInet6Darwin  = 30
+)
+
+// Sizes of the structures, without the sa_len/sa_family header
+const (
+	sizeofSockaddrIn  = 16
+	sizeofSockaddrIn6 = 28
+
+	sizeofSunPathLinux = 108
+	sizeofSunPathBSD   = 104
+)
+
+// Sockaddr emulates the mess that is struct sockaddr. The address is
+// decoded according to its sa_family, both the Linux and the BSD layouts are
+// recognised: on Linux the second byte is the high byte of sa_family, which
+// is always zero, on BSD it is the (never zero) sa_family.
+type Sockaddr []byte
+
+// Layout returns the detected layout of the sockaddr header
+func (sa Sockaddr) Layout() SockaddrLayout {
+	if len(sa) >= 2 && sa[1] != 0 {
+		return LayoutBSD
+	}
+	return LayoutLinux
+}
+
+// family returns the normalised address family, with AF_INET6 mapped to
+// syscall.AF_INET6 regardless of the platform that encoded it.
+func (sa Sockaddr) family() int {
+	if len(sa) < 2 {
+		return 0
+	}
+
+	var af int
+	if sa.Layout() == LayoutBSD {
+		af = int(sa[1])
+	} else {
+		af = int(binary.LittleEndian.Uint16(sa))
+	}
+
+	switch af {
+	case afUnix:
+		return syscall.AF_UNIX
+	case afInet:
+		return syscall.AF_INET
+	case afInet6Linux:
+		if sa.Layout() == LayoutLinux {
+			return syscall.AF_INET6
+		}
+	case afInet6OpenBSD, afInet6FreeBSD, afInet6Darwin:
+		if sa.Layout() == LayoutBSD {
+			return syscall.AF_INET6
+		}
+	}
+	return 0
+}
+
+// AddrPort returns the IP address and port for AF_INET and AF_INET6, or the
+// zero value for other families.
+func (sa Sockaddr) AddrPort() netip.AddrPort {
+	var ip netip.Addr
+	switch sa.family() {
+	case syscall.AF_INET:
+		if len(sa) < 8 {
+			return netip.AddrPort{}
+		}
+		ip = netip.AddrFrom4([4]byte(sa[4:8]))
+	case syscall.AF_INET6:
+		if len(sa) < 24 {
+			return netip.AddrPort{}
+		}
+		ip = netip.AddrFrom16([16]byte(sa[8:24]))
+		if zone := sa.zone(); zone != "" {
+			ip = ip.WithZone(zone)
+		}
+	default:
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(ip, sa.Port())
+}
+
+// zone returns the IPv6 scope, as interface name if possible
+func (sa Sockaddr) zone() string {
+	if len(sa) < sizeofSockaddrIn6 {
+		return ""
+	}
+	id := binary.LittleEndian.Uint32(sa[24:])
+	if id == 0 {
+		return ""
+	}
+	if ifi, err := net.InterfaceByIndex(int(id)); err == nil {
+		return ifi.Name
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// IP returns the IP address for AF_INET and AF_INET6, or nil
+func (sa Sockaddr) IP() net.IP {
+	ap := sa.AddrPort()
+	if !ap.IsValid() {
+		return nil
+	}
+	return net.IP(ap.Addr().AsSlice())
+}
+
+// Port returns the port for AF_INET and AF_INET6, or 0
+func (sa Sockaddr) Port() uint16 {
+	switch sa.family() {
+	case syscall.AF_INET, syscall.AF_INET6:
+		if len(sa) >= 4 {
+			return binary.BigEndian.Uint16(sa[2:4])
+		}
+	}
+	return 0
+}
+
+// Path returns the socket path for AF_UNIX, or the empty string
+func (sa Sockaddr) Path() string {
+	if sa.family() != syscall.AF_UNIX {
+		return ""
+	}
+	path := sa[2:]
+	if i := bytes.IndexByte(path, 0); i >= 0 {
+		path = path[:i]
+	}
+	return string(path)
+}
+
+// Addr converts the address to a *net.TCPAddr or *net.UnixAddr. Addresses
+// of an unknown family are returned as is.
+func (sa Sockaddr) Addr() net.Addr {
+	switch sa.family() {
+	case syscall.AF_INET, syscall.AF_INET6:
+		if ap := sa.AddrPort(); ap.IsValid() {
+			return net.TCPAddrFromAddrPort(ap)
+		}
+	case syscall.AF_UNIX:
+		return &net.UnixAddr{Name: sa.Path(), Net: "unix"}
+	}
+	return sa
+}
+
+// Network returns the network name for the address family
+func (sa Sockaddr) Network() string {
+	switch sa.family() {
+	case syscall.AF_INET:
+		return "tcp4"
+	case syscall.AF_INET6:
+		return "tcp6"
+	case syscall.AF_UNIX:
+		return "unix"
+	default:
+		return "unknown"
+	}
+}
+
+func (sa Sockaddr) String() string {
+	switch sa.family() {
+	case syscall.AF_INET, syscall.AF_INET6:
+		return sa.AddrPort().String()
+	case syscall.AF_UNIX:
+		return sa.Path()
+	default:
+		return fmt.Sprintf("<sockaddr %x>", []byte(sa))
+	}
+}
+
+// NewSockaddr encodes a *net.TCPAddr, *net.UDPAddr or *net.UnixAddr as
+// struct sockaddr in the requested layout. For LayoutBSD on a non-BSD
+// platform, OpenBSD's AF_INET6 is used.
+func NewSockaddr(addr net.Addr, layout SockaddrLayout) (Sockaddr, error) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return newSockaddrInet(addr.AddrPort(), layout), nil
+	case *net.UDPAddr:
+		return newSockaddrInet(addr.AddrPort(), layout), nil
+	case *net.UnixAddr:
+		size := sizeofSunPathLinux
+		if layout == LayoutBSD {
+			size = sizeofSunPathBSD
+		}
+		if len(addr.Name) >= size {
+			return nil, fmt.Errorf("imsg: UNIX socket path %q too long", addr.Name)
+		}
+		sa := make(Sockaddr, 2+size)
+		putFamily(sa, afUnix, layout)
+		copy(sa[2:], addr.Name)
+		return sa, nil
+	case Sockaddr:
+		return addr, nil
+	default:
+		return nil, fmt.Errorf("imsg: can not encode %T as sockaddr", addr)
+	}
+}
+
+func newSockaddrInet(ap netip.AddrPort, layout SockaddrLayout) Sockaddr {
+	var sa Sockaddr
+	if ip := ap.Addr(); ip.Is4() || ip.Is4In6() {
+		sa = make(Sockaddr, sizeofSockaddrIn)
+		putFamily(sa, afInet, layout)
+		ip4 := ip.Unmap().As4()
+		copy(sa[4:], ip4[:])
+	} else {
+		sa = make(Sockaddr, sizeofSockaddrIn6)
+		af := afInet6Linux
+		if layout == LayoutBSD {
+			af = afInet6OpenBSD
+			if NativeLayout == LayoutBSD {
+				af = syscall.AF_INET6
+			}
+		}
+		putFamily(sa, af, layout)
+		ip16 := ip.As16()
+		copy(sa[8:], ip16[:])
+		if zone := ip.Zone(); zone != "" {
+			if ifi, err := net.InterfaceByName(zone); err == nil {
+				binary.LittleEndian.PutUint32(sa[24:], uint32(ifi.Index))
+			} else if id, err := strconv.ParseUint(zone, 10, 32); err == nil {
+				binary.LittleEndian.PutUint32(sa[24:], uint32(id))
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(sa[2:], ap.Port())
+	return sa
+}
+
+func putFamily(sa Sockaddr, af int, layout SockaddrLayout) {
+	if layout == LayoutBSD {
+		sa[0] = byte(len(sa))
+		sa[1] = byte(af)
+	} else {
+		binary.LittleEndian.PutUint16(sa, uint16(af))
+	}
+}
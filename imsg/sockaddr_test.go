@@ -0,0 +1,138 @@
+package imsg
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+var sockaddrTests = []struct {
+	Name    string
+	Data    Sockaddr
+	Layout  SockaddrLayout
+	Network string
+	String  string
+	Addr    net.Addr
+}{
+	{
+		"linux inet",
+		Sockaddr{2, 0, 0, 25, 192, 0, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+		LayoutLinux, "tcp4", "192.0.2.1:25",
+		&net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 25},
+	},
+	{
+		"bsd inet",
+		Sockaddr{16, 2, 0x01, 0xbb, 192, 0, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+		LayoutBSD, "tcp4", "192.0.2.1:443",
+		&net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 443},
+	},
+	{
+		"linux inet6",
+		Sockaddr{
+			10, 0, 0, 25, 0, 0, 0, 0,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0, 0, 0, 0,
+		},
+		LayoutLinux, "tcp6", "[2001:db8::1]:25",
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25},
+	},
+	{
+		"openbsd inet6",
+		Sockaddr{
+			28, 24, 0, 25, 0, 0, 0, 0,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0, 0, 0, 0,
+		},
+		LayoutBSD, "tcp6", "[2001:db8::1]:25",
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25},
+	},
+	{
+		"freebsd inet6",
+		Sockaddr{
+			28, 28, 0, 25, 0, 0, 0, 0,
+			0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+			0, 0, 0, 0,
+		},
+		LayoutBSD, "tcp6", "[2001:db8::1]:25",
+		&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25},
+	},
+	{
+		"linux unix",
+		append(Sockaddr{1, 0}, "/var/run/smtpd.sock\x00\x00\x00"...),
+		LayoutLinux, "unix", "/var/run/smtpd.sock",
+		&net.UnixAddr{Name: "/var/run/smtpd.sock", Net: "unix"},
+	},
+	{
+		"bsd unix",
+		append(Sockaddr{22, 1}, "/var/run/smtpd.sock\x00"...),
+		LayoutBSD, "unix", "/var/run/smtpd.sock",
+		&net.UnixAddr{Name: "/var/run/smtpd.sock", Net: "unix"},
+	},
+	{
+		"unknown",
+		Sockaddr{16, 0xf0, 0, 0},
+		LayoutBSD, "unknown", "<sockaddr 10f00000>",
+		Sockaddr{16, 0xf0, 0, 0},
+	},
+}
+
+func TestSockaddr(t *testing.T) {
+	for _, test := range sockaddrTests {
+		t.Run(test.Name, func(t *testing.T) {
+			if l := test.Data.Layout(); l != test.Layout {
+				t.Errorf("expected layout %s, got %s", test.Layout, l)
+			}
+			if n := test.Data.Network(); n != test.Network {
+				t.Errorf("expected network %q, got %q", test.Network, n)
+			}
+			if s := test.Data.String(); s != test.String {
+				t.Errorf("expected string %q, got %q", test.String, s)
+			}
+			if a := test.Data.Addr(); !reflect.DeepEqual(a, test.Addr) {
+				t.Errorf("expected addr %#v, got %#v", test.Addr, a)
+			}
+		})
+	}
+}
+
+func TestNewSockaddr(t *testing.T) {
+	for _, test := range sockaddrTests {
+		if _, ok := test.Addr.(Sockaddr); ok {
+			continue
+		}
+		t.Run(test.Name, func(t *testing.T) {
+			sa, err := NewSockaddr(test.Addr, test.Layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a := sa.Addr(); !reflect.DeepEqual(a, test.Addr) {
+				t.Errorf("expected addr %#v, got %#v", test.Addr, a)
+			}
+			if l := sa.Layout(); l != test.Layout {
+				t.Errorf("expected layout %s, got %s", test.Layout, l)
+			}
+		})
+	}
+}
+
+func TestSockaddrAddrPort(t *testing.T) {
+	want := netip.MustParseAddrPort("[2001:db8::1]:2525")
+	sa, err := NewSockaddr(net.TCPAddrFromAddrPort(want), LayoutLinux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap := sa.AddrPort(); ap != want {
+		t.Fatalf("expected %s, got %s", want, ap)
+	}
+	if ip := sa.IP(); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("expected IP 2001:db8::1, got %s", ip)
+	}
+}
+
+func TestNewSockaddrPathTooLong(t *testing.T) {
+	addr := &net.UnixAddr{Name: string(make([]byte, sizeofSunPathBSD)), Net: "unix"}
+	if _, err := NewSockaddr(addr, LayoutBSD); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,51 @@
+package opensmtpd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// Logger receives the log messages of a Filter or a Table, *slog.Logger
+// implements it. Messages carry attributes such as the session, the query ID
+// and the verdict, so handlers can filter and format them.
+//
+// Traces of every message exchanged with smtpd are logged at debug level,
+// problems of the filter or its callbacks as warnings or errors. Attributes
+// are only built for enabled levels.
+type Logger interface {
+	Enabled(ctx context.Context, level slog.Level) bool
+	LogAttrs(ctx context.Context, level slog.Level, msg string, attrs ...slog.Attr)
+}
+
+// debugLogger is the default logger if Debug is set
+var debugLogger = sync.OnceValue(func() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+})
+
+// logAt returns l, or the default logger if l is nil, if it logs at level.
+// Otherwise it returns nil, callers check it before building attributes:
+//
+//	if l := logAt(f.Logger, slog.LevelDebug); l != nil {
+//		l.LogAttrs(ctx, slog.LevelDebug, "message", attrs...)
+//	}
+func logAt(l Logger, level slog.Level) Logger {
+	if l == nil {
+		if Debug {
+			l = debugLogger()
+		} else {
+			l = slog.Default()
+		}
+	}
+	if l.Enabled(context.Background(), level) {
+		return l
+	}
+	return nil
+}
+
+// idAttr formats a session or query ID like smtpd does
+func idAttr(key string, id uint64) slog.Attr {
+	return slog.String(key, fmt.Sprintf("%016x", id))
+}
@@ -0,0 +1,121 @@
+package opensmtpd
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
+// testDiscard is the logger of filters and tables under test
+var testDiscard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testLogger records the messages logged at or above its level
+type testLogger struct {
+	level slog.Level
+
+	mu      sync.Mutex
+	records []testRecord
+}
+
+type testRecord struct {
+	level slog.Level
+	msg   string
+	attrs map[string]string
+}
+
+func (l *testLogger) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= l.level
+}
+
+func (l *testLogger) LogAttrs(_ context.Context, level slog.Level, msg string, attrs ...slog.Attr) {
+	r := testRecord{level: level, msg: msg, attrs: make(map[string]string)}
+	for _, attr := range attrs {
+		r.attrs[attr.Key] = attr.Value.String()
+	}
+	l.mu.Lock()
+	l.records = append(l.records, r)
+	l.mu.Unlock()
+}
+
+func (l *testLogger) find(msg string) *testRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.records {
+		if l.records[i].msg == msg {
+			return &l.records[i]
+		}
+	}
+	return nil
+}
+
+func TestFilterLogger(t *testing.T) {
+	logger := &testLogger{level: slog.LevelDebug}
+	ts := newTestSession(t, &Filter{
+		MAIL: func(s *Session, user, domain string) error {
+			return s.RejectCode(FilterFail, 550, "no thanks")
+		},
+		Logger: logger,
+	})
+
+	query := ts.query(0x2a, 0x2b, queryMAIL)
+	query.PutTypeMailaddr("user", "example.org")
+	ts.roundTrip(query)
+
+	r := logger.find("filter response")
+	if r == nil {
+		t.Fatalf("no response logged, got %+v", logger.records)
+	}
+	for key, want := range map[string]string{
+		"session": "000000000000002a",
+		"qid":     "000000000000002b",
+		"query":   queryName(queryMAIL),
+		"hook":    HookMAIL.String(),
+		"verdict": responseName(FilterFail),
+		"code":    "550",
+		"line":    "no thanks",
+	} {
+		if got := r.attrs[key]; got != want {
+			t.Errorf("expected %s=%q, got %q", key, want, got)
+		}
+	}
+	if r.level != slog.LevelDebug {
+		t.Errorf("expected level %s, got %s", slog.LevelDebug, r.level)
+	}
+}
+
+func TestFilterLoggerDisabled(t *testing.T) {
+	logger := &testLogger{level: slog.LevelError}
+	ts := newTestSession(t, &Filter{
+		HELO: func(session *Session, helo string) error {
+			return session.Accept()
+		},
+		Logger: logger,
+	})
+
+	query := ts.query(1, 2, queryHELO)
+	query.PutTypeString("mx.example.org")
+	reply := new(imsg.Message)
+
+	handle := func() {
+		ts.handle(query)
+		if err := ts.smtpd.ReadMessage(reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The session is created by the first query
+	handle()
+	without := testing.AllocsPerRun(100, handle)
+
+	logger.level = slog.LevelDebug
+	with := testing.AllocsPerRun(100, handle)
+	logger.records = nil
+
+	if without >= with {
+		t.Fatalf("expected fewer allocations with debug disabled, got %.0f, %.0f with debug", without, with)
+	}
+}
@@ -0,0 +1,487 @@
+package opensmtpd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// maxHeaderLineSize is the length new header fields are folded at
+const maxHeaderLineSize = 78
+
+// Message is an email message, as received through the data pipe. It is
+// parsed leniently: anything that does not look like a header or a MIME
+// structure is kept as body. A message that is not modified is written back
+// byte for byte.
+type Message struct {
+	Part
+}
+
+// Part is a MIME entity: the message itself, or one of its parts.
+type Part struct {
+	Header Header
+
+	// Body is the raw (transfer encoded) body of a part that is not
+	// multipart, or that could not be parsed as such.
+	Body []byte
+
+	// Parts are the parts of a multipart entity. Parts may be modified,
+	// added or removed; the boundary of the entity is kept.
+	Parts []*Part
+
+	// nl is the line terminator in use
+	nl string
+
+	// hsep is the empty line separating header and body, nil if the part
+	// has no body
+	hsep []byte
+
+	// delim is the raw delimiter line preceding the part, and sep the line
+	// terminator that precedes the next delimiter
+	delim, sep []byte
+
+	// boundary of a multipart entity, with the raw data around its parts
+	boundary         string
+	preamble, end    []byte
+	hasEnd, hasParts bool
+}
+
+// ParseMessage parses a message body
+func ParseMessage(b []byte) *Message {
+	nl := "\n"
+	if i := bytes.IndexByte(b, '\n'); i > 0 && b[i-1] == '\r' {
+		nl = "\r\n"
+	}
+	m := new(Message)
+	m.parse(b, nl)
+	return m
+}
+
+// WriteTo writes the message, with its modifications
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	m.writeTo(&b, m.newline())
+	return b.WriteTo(w)
+}
+
+// Bytes returns the message, with its modifications
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+	m.writeTo(&b, m.newline())
+	return b.Bytes()
+}
+
+func (p *Part) newline() string {
+	if p.nl == "" {
+		return "\n"
+	}
+	return p.nl
+}
+
+func (p *Part) parse(b []byte, nl string) {
+	p.nl = nl
+	p.Header.nl = nl
+
+	// Header fields, up to the first empty line
+	for len(b) > 0 {
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+		}
+		if isEmptyLine(line) {
+			p.hsep = line
+			b = b[len(line):]
+			break
+		}
+
+		// Continuation lines belong to the field
+		n := len(line)
+		for n < len(b) && (b[n] == ' ' || b[n] == '\t') {
+			if i := bytes.IndexByte(b[n:], '\n'); i >= 0 {
+				n += i + 1
+			} else {
+				n = len(b)
+			}
+		}
+		f, ok := parseHeaderField(b[:n])
+		if !ok {
+			// Not a header, the rest is body
+			break
+		}
+		p.Header.fields = append(p.Header.fields, f)
+		b = b[n:]
+	}
+	p.Body = b
+
+	if mediaType, params := p.MediaType(); strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		p.parseMultipart(b, params["boundary"], nl)
+	}
+}
+
+func isEmptyLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// parseMultipart splits a multipart body into its parts. The line
+// terminator preceding a delimiter line belongs to the delimiter (RFC 2046).
+func (p *Part) parseMultipart(b []byte, boundary, nl string) {
+	var (
+		delim     = []byte("--" + boundary)
+		lastDelim []byte
+		start     = -1
+		pos       int
+	)
+	for pos < len(b) {
+		line := b[pos:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		}
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+
+		if bytes.HasPrefix(trimmed, delim) {
+			isEnd := bytes.Equal(trimmed[len(delim):], []byte("--"))
+			if isEnd || len(trimmed) == len(delim) {
+				if start < 0 {
+					p.preamble = b[:pos]
+				} else {
+					p.addPart(lastDelim, b[start:pos], nl, true)
+				}
+				if isEnd {
+					p.hasEnd = true
+					p.end = b[pos:]
+					break
+				}
+				lastDelim = line
+				start = pos + len(line)
+			}
+		}
+		pos += len(line)
+	}
+	if start < 0 {
+		// No delimiter, not multipart after all
+		p.preamble = nil
+		return
+	}
+	if !p.hasEnd {
+		// Truncated, the last part runs to the end
+		p.addPart(lastDelim, b[start:], nl, false)
+		p.end = []byte{}
+	}
+	p.boundary = boundary
+	p.hasParts = true
+	p.Body = nil
+}
+
+func (p *Part) addPart(delim, b []byte, nl string, delimited bool) {
+	part := &Part{delim: delim, sep: []byte{}}
+	switch {
+	case !delimited:
+	case bytes.HasSuffix(b, []byte("\r\n")):
+		part.sep, b = b[len(b)-2:], b[:len(b)-2]
+	case bytes.HasSuffix(b, []byte("\n")):
+		part.sep, b = b[len(b)-1:], b[:len(b)-1]
+	}
+	part.parse(b, nl)
+	p.Parts = append(p.Parts, part)
+}
+
+func (p *Part) writeTo(b *bytes.Buffer, nl string) {
+	p.Header.writeTo(b)
+	if p.hsep != nil {
+		b.Write(p.hsep)
+	} else if p.nl == "" && (len(p.Body) > 0 || len(p.Parts) > 0) {
+		// Added part
+		b.WriteString(nl)
+	}
+
+	if !p.hasParts && len(p.Parts) == 0 {
+		b.Write(p.Body)
+		return
+	}
+
+	boundary := p.boundary
+	if boundary == "" {
+		_, params := p.MediaType()
+		boundary = params["boundary"]
+	}
+	b.Write(p.preamble)
+	for _, part := range p.Parts {
+		if part.delim != nil {
+			b.Write(part.delim)
+		} else {
+			b.WriteString("--" + boundary + nl)
+		}
+		part.writeTo(b, nl)
+		if part.sep != nil {
+			b.Write(part.sep)
+		} else {
+			b.WriteString(nl)
+		}
+	}
+	if p.end != nil {
+		b.Write(p.end)
+	} else {
+		b.WriteString("--" + boundary + "--" + nl)
+	}
+}
+
+// MediaType returns the media type of the part and its parameters, the
+// default is text/plain.
+func (p *Part) MediaType() (string, map[string]string) {
+	v := p.Header.Get("Content-Type")
+	if v == "" {
+		return "text/plain", map[string]string{}
+	}
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return "text/plain", map[string]string{}
+	}
+	return mediaType, params
+}
+
+// IsMultipart reports if the part consists of other parts
+func (p *Part) IsMultipart() bool {
+	return p.hasParts || len(p.Parts) > 0
+}
+
+// DecodedBody returns the body with its Content-Transfer-Encoding
+// (base64 or quoted-printable) removed.
+func (p *Part) DecodedBody() ([]byte, error) {
+	switch strings.ToLower(p.Header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, p.Body)
+		b := make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		n, err := base64.StdEncoding.Decode(b, clean)
+		return b[:n], err
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.Body)))
+	default:
+		return p.Body, nil
+	}
+}
+
+// SetDecodedBody replaces the body, encoding it with the part's
+// Content-Transfer-Encoding.
+func (p *Part) SetDecodedBody(b []byte) error {
+	nl := p.newline()
+	switch strings.ToLower(p.Header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		s := base64.StdEncoding.EncodeToString(b)
+		var out bytes.Buffer
+		for len(s) > 76 {
+			out.WriteString(s[:76] + nl)
+			s = s[76:]
+		}
+		if len(s) > 0 {
+			out.WriteString(s + nl)
+		}
+		p.Body = out.Bytes()
+	case "quoted-printable":
+		var out bytes.Buffer
+		w := quotedprintable.NewWriter(&out)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		p.Body = out.Bytes()
+		if nl != "\r\n" {
+			p.Body = bytes.Replace(p.Body, []byte("\r\n"), []byte(nl), -1)
+		}
+	default:
+		p.Body = b
+	}
+	return nil
+}
+
+// HeaderField is a header field, with its value unfolded
+type HeaderField struct {
+	Key, Value string
+}
+
+// Header is the header of a message or part. Keys are case insensitive;
+// fields keep their order and, unless modified, their folding.
+type Header struct {
+	fields []headerField
+	nl     string
+}
+
+type headerField struct {
+	key, value string
+
+	// raw is the field as received, including folding and terminator
+	raw []byte
+}
+
+func parseHeaderField(raw []byte) (headerField, bool) {
+	i := bytes.IndexByte(raw, ':')
+	if i <= 0 {
+		return headerField{}, false
+	}
+	key := string(bytes.TrimRight(raw[:i], " \t"))
+	if strings.ContainsAny(key, " \t\r\n") {
+		return headerField{}, false
+	}
+	value := bytes.Replace(raw[i+1:], []byte("\n"), nil, -1)
+	value = bytes.Replace(value, []byte("\r"), nil, -1)
+	return headerField{
+		key:   key,
+		value: strings.TrimSpace(string(value)),
+		raw:   raw,
+	}, true
+}
+
+// ErrInvalidHeader is returned for a header field that can not be added: a
+// name with characters other than printable ASCII or with a colon, or a value
+// with a line break, which would inject fields of its own.
+var ErrInvalidHeader = errors.New("filter: invalid header field")
+
+func (h *Header) newField(key, value string) (headerField, error) {
+	if key == "" {
+		return headerField{}, fmt.Errorf("%w: empty name", ErrInvalidHeader)
+	}
+	for i := 0; i < len(key); i++ {
+		// RFC 5322 field names are printable US-ASCII, except colon
+		if c := key[i]; c < 33 || c > 126 || c == ':' {
+			return headerField{}, fmt.Errorf("%w: name %q", ErrInvalidHeader, key)
+		}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return headerField{}, fmt.Errorf("%w: line break in the value of %s", ErrInvalidHeader, key)
+	}
+
+	nl := h.nl
+	if nl == "" {
+		nl = "\n"
+	}
+
+	// Fold at spaces, unfolding restores the value
+	var (
+		b strings.Builder
+		n = len(key) + 1
+	)
+	b.WriteString(key)
+	b.WriteByte(':')
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && n+1+len(word) > maxHeaderLineSize {
+			b.WriteString(nl)
+			n = 0
+		}
+		b.WriteByte(' ')
+		b.WriteString(word)
+		n += 1 + len(word)
+	}
+	b.WriteString(nl)
+
+	return headerField{key: key, value: value, raw: []byte(b.String())}, nil
+}
+
+// Get returns the first value for key, or the empty string
+func (h *Header) Get(key string) string {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.key, key) {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// Values returns all values for key
+func (h *Header) Values(key string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.key, key) {
+			values = append(values, f.value)
+		}
+	}
+	return values
+}
+
+// Fields returns all fields, in order
+func (h *Header) Fields() []HeaderField {
+	fields := make([]HeaderField, len(h.fields))
+	for i, f := range h.fields {
+		fields[i] = HeaderField{f.key, f.value}
+	}
+	return fields
+}
+
+// Add appends a field to the header. Invalid fields, see ErrInvalidHeader,
+// are not added.
+func (h *Header) Add(key, value string) error {
+	f, err := h.newField(key, value)
+	if err != nil {
+		return err
+	}
+	h.fields = append(h.fields, f)
+	return nil
+}
+
+// Prepend inserts a field at the top of the header, where trace fields
+// (Received, signatures) go. Invalid fields are not added.
+func (h *Header) Prepend(key, value string) error {
+	f, err := h.newField(key, value)
+	if err != nil {
+		return err
+	}
+	h.fields = append([]headerField{f}, h.fields...)
+	return nil
+}
+
+// Set replaces the first field for key, and removes the others. The field is
+// added if key is not present. Invalid fields leave the header unchanged.
+func (h *Header) Set(key, value string) error {
+	f, err := h.newField(key, value)
+	if err != nil {
+		return err
+	}
+	for i := range h.fields {
+		if strings.EqualFold(h.fields[i].key, key) {
+			// Keep the spelling of the name
+			if f, err = h.newField(h.fields[i].key, value); err != nil {
+				return err
+			}
+			h.fields[i] = f
+			h.del(key, i+1)
+			return nil
+		}
+	}
+	h.fields = append(h.fields, f)
+	return nil
+}
+
+// Del removes all fields for key
+func (h *Header) Del(key string) {
+	h.del(key, 0)
+}
+
+func (h *Header) del(key string, from int) {
+	fields := h.fields[:from]
+	for _, f := range h.fields[from:] {
+		if !strings.EqualFold(f.key, key) {
+			fields = append(fields, f)
+		}
+	}
+	h.fields = fields
+}
+
+func (h *Header) writeTo(b *bytes.Buffer) {
+	for i, f := range h.fields {
+		b.Write(f.raw)
+		if i < len(h.fields)-1 && !bytes.HasSuffix(f.raw, []byte("\n")) {
+			// Unterminated last line, followed by an added field
+			b.WriteString(h.nl)
+		}
+	}
+}
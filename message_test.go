@@ -0,0 +1,173 @@
+package opensmtpd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testMultipart = "Received: from mx.example.org\n" +
+	"\tby mail.example.com; Mon, 1 Jan 2018 00:00:00 +0000\n" +
+	"From: Joe <joe@example.org>\n" +
+	"Subject: test\n" +
+	"MIME-Version: 1.0\n" +
+	"Content-Type: multipart/mixed;\n" +
+	" boundary=\"XyZ\"\n" +
+	"\n" +
+	"This is a multi-part message in MIME format.\n" +
+	"--XyZ\n" +
+	"Content-Type: text/plain; charset=utf-8\n" +
+	"Content-Transfer-Encoding: quoted-printable\n" +
+	"\n" +
+	"Caf=C3=A9\n" +
+	"--XyZ \n" +
+	"Content-Type: application/octet-stream\n" +
+	"Content-Transfer-Encoding: base64\n" +
+	"\n" +
+	"AAEC\n" +
+	"\n" +
+	"--XyZ--\n" +
+	"epilogue\n"
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, body := range []string{
+		testMultipart,
+		strings.Replace(testMultipart, "\n", "\r\n", -1),
+		"Subject: no body",
+		"Subject: empty body\n\n",
+		"no header at all\n",
+		"Content-Type: multipart/mixed; boundary=a\n\nno parts\n",
+		"Content-Type: multipart/mixed; boundary=a\n\n--a\n\ntruncated\n",
+	} {
+		m := ParseMessage([]byte(body))
+		if got := string(m.Bytes()); got != body {
+			t.Errorf("expected %q, got %q", body, got)
+		}
+	}
+}
+
+func TestMessageHeader(t *testing.T) {
+	m := ParseMessage([]byte(testMultipart))
+
+	if v := m.Header.Get("received"); v != "from mx.example.org\tby mail.example.com; Mon, 1 Jan 2018 00:00:00 +0000" {
+		t.Fatalf("unexpected unfolded value %q", v)
+	}
+
+	m.Header.Prepend("X-Spam-Score", "1.5")
+	m.Header.Set("Subject", "[SPAM] test")
+	m.Header.Add("X-Long", strings.Repeat("word ", 30))
+	m.Header.Del("MIME-Version")
+
+	want := []string{"X-Spam-Score", "Received", "From", "Subject", "Content-Type", "X-Long"}
+	fields := m.Header.Fields()
+	if len(fields) != len(want) {
+		t.Fatalf("expected %d fields, got %+v", len(want), fields)
+	}
+	for i, f := range fields {
+		if f.Key != want[i] {
+			t.Fatalf("expected field %d to be %s, got %s", i, want[i], f.Key)
+		}
+	}
+
+	b := m.Bytes()
+	if !bytes.HasPrefix(b, []byte("X-Spam-Score: 1.5\nReceived: from mx.example.org\n\tby")) {
+		t.Fatalf("unexpected header:\n%s", b)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if len(line) > maxHeaderLineSize {
+			t.Fatalf("line not folded: %q", line)
+		}
+	}
+
+	// Folding is undone on parsing
+	if v := ParseMessage(b).Header.Get("X-Long"); v != strings.TrimSpace(strings.Repeat("word ", 30)) {
+		t.Fatalf("unexpected value after folding %q", v)
+	}
+}
+
+func TestMessageHeaderInjection(t *testing.T) {
+	const body = "Subject: test\n\nhello\n"
+	m := ParseMessage([]byte(body))
+
+	for _, field := range [][2]string{
+		{"X-Test", "yes\nBcc: victim@example.org"},
+		{"X-Test", "yes\r\n\r\nforged body"},
+		{"X-Test\nBcc", "victim@example.org"},
+		{"X Test", "yes"},
+		{"X-Test:", "yes"},
+		{"X-Tést", "yes"},
+		{"", "yes"},
+	} {
+		for _, add := range []func(key, value string) error{m.Header.Add, m.Header.Prepend, m.Header.Set} {
+			if err := add(field[0], field[1]); !errors.Is(err, ErrInvalidHeader) {
+				t.Errorf("%q: expected %v, got %v", field, ErrInvalidHeader, err)
+			}
+		}
+	}
+	if got := string(m.Bytes()); got != body {
+		t.Fatalf("expected unchanged message %q, got %q", body, got)
+	}
+
+	if err := m.Header.Set("subject", "folded\tvalue"); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Header.Get("Subject"); got != "folded\tvalue" {
+		t.Fatalf("expected %q, got %q", "folded\tvalue", got)
+	}
+}
+
+func TestMessageParts(t *testing.T) {
+	m := ParseMessage([]byte(testMultipart))
+	if !m.IsMultipart() || len(m.Parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d", len(m.Parts))
+	}
+
+	text := m.Parts[0]
+	if mediaType, params := text.MediaType(); mediaType != "text/plain" || params["charset"] != "utf-8" {
+		t.Fatalf("unexpected media type %s %v", mediaType, params)
+	}
+	b, err := text.DecodedBody()
+	if err != nil || string(b) != "Café" {
+		t.Fatalf("unexpected text %q (%v)", b, err)
+	}
+	if err = text.SetDecodedBody(append(b, "\n--\nDisclaimer"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err = m.Parts[1].DecodedBody(); err != nil || !bytes.Equal(b, []byte{0, 1, 2}) {
+		t.Fatalf("unexpected data %v (%v)", b, err)
+	}
+
+	m.Parts = append(m.Parts, &Part{Body: []byte("added")})
+	m.Parts[2].Header.Add("Content-Type", "text/plain")
+
+	want := strings.Replace(testMultipart, "Caf=C3=A9\n", "Caf=C3=A9\n--\nDisclaimer\n", 1)
+	want = strings.Replace(want, "--XyZ--\n", "--XyZ\nContent-Type: text/plain\n\nadded\n--XyZ--\n", 1)
+	if got := string(m.Bytes()); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func ExampleMessage() {
+	filter := &Filter{
+		Message: func(session *Session, m *Message) error {
+			if strings.Contains(m.Header.Get("Subject"), "viagra") {
+				m.Header.Prepend("X-Spam", "yes")
+			}
+			return session.Accept()
+		},
+	}
+	filter.Serve()
+}
+
+func ExampleParseMessage() {
+	m := ParseMessage([]byte("Subject: hello\n\nworld\n"))
+	m.Header.Set("Subject", "[tagged] "+m.Header.Get("Subject"))
+	fmt.Printf("%s", m.Bytes())
+	// Output:
+	// Subject: [tagged] hello
+	//
+	// world
+}
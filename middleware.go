@@ -0,0 +1,68 @@
+package opensmtpd
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Middleware wraps the callbacks of a filter, for example to log or time
+// them. name is the query or event the callback is called for, as named by
+// smtpd (QUERY_MAIL, EVENT_DISCONNECT, ...); next calls the callback, or the
+// next middleware. The body callbacks are called for QUERY_DATALINE.
+//
+// A callback may respond to its query after next returns.
+type Middleware func(s *Session, name string, next func() error) error
+
+// Use adds middleware to the filter, the first added is the outermost.
+func (f *Filter) Use(middleware ...Middleware) {
+	f.middleware = append(f.middleware, middleware...)
+}
+
+// call runs a callback through the middleware
+func (f *Filter) call(s *Session, name string, callback func() error) error {
+	for i := len(f.middleware) - 1; i >= 0; i-- {
+		mw, next := f.middleware[i], callback
+		callback = func() error { return mw(s, name, next) }
+	}
+	return callback()
+}
+
+// LogMiddleware logs every callback at debug level, with its duration and
+// error. A nil logger is the default logger, as for Filter.Logger.
+func LogMiddleware(logger Logger) Middleware {
+	return TimingMiddleware(func(s *Session, name string, d time.Duration, err error) {
+		if l := logAt(logger, slog.LevelDebug); l != nil {
+			attrs := []slog.Attr{
+				idAttr("session", s.ID),
+				slog.String("callback", name),
+				slog.Duration("duration", d),
+			}
+			if err != nil {
+				attrs = append(attrs, slog.Any("error", err))
+			}
+			l.LogAttrs(context.Background(), slog.LevelDebug, "filter callback", attrs...)
+		}
+	})
+}
+
+// TimingMiddleware calls observe with the duration and the error of every
+// callback, for example to record them as metrics. The duration does not
+// include a response made after the callback returned.
+func TimingMiddleware(observe func(s *Session, name string, d time.Duration, err error)) Middleware {
+	return func(s *Session, name string, next func() error) error {
+		start := time.Now()
+		err := next()
+		observe(s, name, time.Since(start), err)
+		return err
+	}
+}
+
+// RecoverMiddleware returns a panic of a callback as a *PanicError. The
+// filter recovers panics anyway, outside of its middleware; added after
+// LogMiddleware or TimingMiddleware, those see panics as errors.
+func RecoverMiddleware() Middleware {
+	return func(s *Session, name string, next func() error) error {
+		return recovered(next)
+	}
+}
@@ -0,0 +1,62 @@
+package opensmtpd
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	var (
+		logger = &testLogger{level: slog.LevelDebug}
+		timed  []error
+	)
+	f := &Filter{
+		HELO: func(s *Session, helo string) error {
+			return s.Accept()
+		},
+		MAIL: func(s *Session, user, domain string) error {
+			panic("mail")
+		},
+		ErrorPolicy: PolicyFailClosed,
+	}
+	f.Use(
+		LogMiddleware(logger),
+		TimingMiddleware(func(s *Session, name string, d time.Duration, err error) {
+			if s.ID != 1 || d < 0 {
+				t.Errorf("%s: unexpected session %d or duration %s", name, s.ID, d)
+			}
+			timed = append(timed, err)
+		}),
+		RecoverMiddleware(),
+	)
+	ts := newTestSession(t, f)
+
+	m := ts.query(1, 2, queryHELO)
+	m.PutTypeString("mx.example.org")
+	if r := ts.roundTrip(m); r.Status != FilterOK {
+		t.Fatalf("expected acceptance, got %+v", r)
+	}
+	m = ts.query(1, 3, queryMAIL)
+	m.PutTypeMailaddr("joe", "example.org")
+	if r := ts.roundTrip(m); r.Status != FilterFail || r.Code != 451 {
+		t.Fatalf("expected %+v, got %+v", VerdictTempfail, r)
+	}
+
+	var perr *PanicError
+	if len(timed) != 2 || timed[0] != nil || !errors.As(timed[1], &perr) {
+		t.Fatalf("expected a success and a panic timed, got %v", timed)
+	}
+
+	r := logger.find("filter callback")
+	if r == nil {
+		t.Fatalf("no callback logged, got %+v", logger.records)
+	}
+	if r.attrs["callback"] != queryName(queryHELO) || r.attrs["duration"] == "" || r.attrs["error"] != "" {
+		t.Fatalf("unexpected record %+v", r)
+	}
+	if n := f.ErrorCounts()[queryName(queryMAIL)]; n != 1 {
+		t.Fatalf("expected 1 failure, got %d", n)
+	}
+}
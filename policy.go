@@ -0,0 +1,220 @@
+package opensmtpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+)
+
+// Policy decides what a filter does when a callback fails, by returning an
+// error or by panicking.
+type Policy int
+
+// Error policies
+const (
+	// PolicyStop stops Serve with the error of the callback, all sessions
+	// are affected. It is the default.
+	PolicyStop Policy = iota
+
+	// PolicyFailOpen accepts the query of the failed callback, if it was
+	// not answered yet, and keeps serving.
+	PolicyFailOpen
+
+	// PolicyFailClosed answers the query of the failed callback with
+	// VerdictTempfail, if it was not answered yet, and keeps serving.
+	PolicyFailClosed
+)
+
+var policyTypeName = map[Policy]string{
+	PolicyStop:       "stop",
+	PolicyFailOpen:   "fail-open",
+	PolicyFailClosed: "fail-closed",
+}
+
+func (p Policy) String() string {
+	if s, ok := policyTypeName[p]; ok {
+		return s
+	}
+	return fmt.Sprintf("UNKNOWN %d", int(p))
+}
+
+// eventHook is the hook an event is sent for, events without hook are only
+// sent with FlagEvents
+var eventHook = map[int]Hook{
+	eventReset:      HookReset,
+	eventDisconnect: HookDisconnect,
+	eventTXCommit:   HookCommit,
+	eventTXRollback: HookRollback,
+}
+
+// PanicError is the error of a callback that panicked
+type PanicError struct {
+	// Value is the value passed to panic
+	Value interface{}
+
+	// Stack is the stack trace of the panicking goroutine
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("filter: callback panicked: %v", e.Value)
+}
+
+// ErrorCounts returns the number of failed callbacks, by query or event name
+// (QUERY_MAIL, EVENT_DISCONNECT, ...). Failures of the body callbacks are
+// counted for QUERY_DATALINE.
+func (f *Filter) ErrorCounts() map[string]uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counts := make(map[string]uint64, len(f.errCounts))
+	for name, n := range f.errCounts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// policy returns the error policy of a hook
+func (f *Filter) policy(hook Hook) Policy {
+	if p, ok := f.HookErrorPolicy[hook]; ok {
+		return p
+	}
+	return f.ErrorPolicy
+}
+
+// protect runs a callback through the middleware, a panic is returned as a
+// *PanicError
+func (f *Filter) protect(s *Session, name string, callback func() error) error {
+	return recovered(func() error { return f.call(s, name, callback) })
+}
+
+// recovered calls callback, a panic is returned as a *PanicError
+func recovered(callback func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return callback()
+}
+
+// callQuery runs the callback answering a query, and applies the error policy
+// of its hook if it fails
+func (f *Filter) callQuery(s *Session, t int, qid uint64, callback func() error) error {
+	return f.queryFailed(s, t, qid, f.protect(s, queryName(t), callback))
+}
+
+// callLink passes a query on to filter i of a chain. Accept may be
+// called from another goroutine than that of the callback, so the next
+// callback gets its own recovery and error policy; the error is marked as
+// handled for the callbacks up the stack, and stops Serve regardless of the
+// goroutine.
+func (f *Filter) callLink(s *Session, t int, qid uint64, l *link, i int) error {
+	if err := f.queryFailed(s, t, qid, recovered(func() error { return l.next(i) })); err != nil {
+		f.fail(err)
+		return handledError{err}
+	}
+	return nil
+}
+
+// handledError is a failure the error policy was applied to already
+type handledError struct {
+	error
+}
+
+func (err handledError) Unwrap() error {
+	return err.error
+}
+
+// queryFailed applies the error policy of the hook of a query to err, the
+// error of its callback
+func (f *Filter) queryFailed(s *Session, t int, qid uint64, err error) error {
+	if err == nil {
+		return nil
+	}
+	var handled handledError
+	if errors.As(err, &handled) {
+		return handled.error
+	}
+
+	name := queryName(t)
+	policy := f.policy(queryHook[t])
+	f.failed(s, name, policy, err)
+	switch policy {
+	case PolicyFailOpen:
+		return f.respondPending(s, qid, VerdictAccept)
+	case PolicyFailClosed:
+		return f.respondPending(s, qid, VerdictTempfail)
+	default:
+		return err
+	}
+}
+
+// callEvent runs an event callback, and applies the error policy of its hook
+// if it fails: there is no query to answer, so it only matters whether Serve
+// stops.
+func (f *Filter) callEvent(s *Session, t int, callback func() error) error {
+	name := eventName(t)
+	err := f.protect(s, name, callback)
+	if err == nil {
+		return nil
+	}
+
+	policy := f.policy(eventHook[t])
+	f.failed(s, name, policy, err)
+	if policy == PolicyStop {
+		return err
+	}
+	return nil
+}
+
+// bodyFailed applies the error policy of HookDataLine to a failure of the
+// data pipe, answering the EOM query. The message passed on to smtpd is
+// incomplete, so it is never accepted: PolicyFailOpen fails closed.
+func (f *Filter) bodyFailed(s *Session, qid uint64, err error) error {
+	policy := f.policy(HookDataLine)
+	f.failed(s, queryName(queryDataLine), policy, err)
+	if policy == PolicyStop {
+		return err
+	}
+	return f.respondPending(s, qid, VerdictTempfail)
+}
+
+// failed counts, logs and reports a failed callback
+func (f *Filter) failed(s *Session, name string, policy Policy, err error) {
+	f.mu.Lock()
+	if f.errCounts == nil {
+		f.errCounts = make(map[string]uint64)
+	}
+	f.errCounts[name]++
+	f.mu.Unlock()
+
+	if l := logAt(f.Logger, slog.LevelError); l != nil {
+		attrs := []slog.Attr{
+			idAttr("session", s.ID),
+			slog.String("callback", name),
+			slog.String("policy", policy.String()),
+			slog.Any("error", err),
+		}
+		if perr, ok := err.(*PanicError); ok {
+			attrs = append(attrs, slog.String("stack", string(perr.Stack)))
+		}
+		l.LogAttrs(context.Background(), slog.LevelError, "filter callback failed", attrs...)
+	}
+
+	if f.Error != nil {
+		f.Error(s, name, err)
+	}
+}
+
+// respondPending answers a query with a verdict, unless the callback did
+// already
+func (f *Filter) respondPending(s *Session, qid uint64, v Verdict) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.responded || s.qid != qid {
+		return nil
+	}
+	return f.respondLocked(s, v.Status, v.Code, v.Line)
+}
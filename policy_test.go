@@ -0,0 +1,119 @@
+package opensmtpd
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
+func TestFilterErrorPolicy(t *testing.T) {
+	var (
+		errLookup = errors.New("lookup failed")
+		reported  []error
+	)
+	f := &Filter{
+		HELO: func(s *Session, helo string) error {
+			return errLookup
+		},
+		MAIL: func(s *Session, user, domain string) error {
+			var m map[string]string
+			m[user] = domain // a bug
+			return s.Accept()
+		},
+		RCPT: func(s *Session, user, domain string) error {
+			return errLookup
+		},
+		Reset: func(s *Session) error {
+			panic("reset")
+		},
+		ErrorPolicy:     PolicyFailClosed,
+		HookErrorPolicy: map[Hook]Policy{HookHELO: PolicyFailOpen, HookRCPT: PolicyStop},
+		Error: func(s *Session, name string, err error) {
+			reported = append(reported, err)
+		},
+	}
+	ts := newTestSession(t, f)
+
+	query := func(qid uint64, qtype int) (response filterResponse, err error) {
+		t.Helper()
+		m := ts.query(1, qid, qtype)
+		if qtype == queryHELO {
+			m.PutTypeString("mx.example.org")
+		} else {
+			m.PutTypeMailaddr("joe", "example.org")
+		}
+		if err = ts.send(m); err == nil {
+			ts.reply(&response)
+		}
+		return
+	}
+
+	// Fails open
+	if r, err := query(2, queryHELO); err != nil || r.Status != FilterOK {
+		t.Fatalf("expected acceptance, got %+v (%v)", r, err)
+	}
+
+	// Fails closed, the panic is recovered
+	if r, err := query(3, queryMAIL); err != nil || r.Status != FilterFail || r.Code != 451 {
+		t.Fatalf("expected %+v, got %+v (%v)", VerdictTempfail, r, err)
+	}
+	if len(reported) != 2 || reported[0] != errLookup {
+		t.Fatalf("expected 2 reported errors, got %v", reported)
+	}
+	if perr, ok := reported[1].(*PanicError); !ok || len(perr.Stack) == 0 {
+		t.Fatalf("expected %T with stack, got %#v", perr, reported[1])
+	}
+
+	// Event callbacks have no query to answer
+	m := imsg.NewMessage(typeFilterEvent)
+	m.PutTypeID(1)
+	m.PutTypeInt(eventReset)
+	if err := ts.send(m); err != nil {
+		t.Fatalf("expected the event failure to be ignored, got %v", err)
+	}
+
+	// Stops
+	if _, err := query(4, queryRCPT); err != errLookup {
+		t.Fatalf("expected %v, got %v", errLookup, err)
+	}
+
+	want := map[string]uint64{
+		queryName(queryHELO):  1,
+		queryName(queryMAIL):  1,
+		queryName(queryRCPT):  1,
+		eventName(eventReset): 1,
+	}
+	counts := f.ErrorCounts()
+	if len(counts) != len(want) {
+		t.Fatalf("expected error counts %v, got %v", want, counts)
+	}
+	for name, n := range want {
+		if counts[name] != n {
+			t.Fatalf("expected error counts %v, got %v", want, counts)
+		}
+	}
+}
+
+func TestFilterBodyPanic(t *testing.T) {
+	f := &Filter{
+		DataLine: func(s *Session, line string) error {
+			if line == "boom" {
+				panic(line)
+			}
+			return s.WriteLine(line)
+		},
+		EOM: func(s *Session, datalen uint32) error {
+			return s.Accept()
+		},
+		ErrorPolicy: PolicyFailOpen,
+	}
+
+	_, response := testFilterPipe(t, f, "Subject: test\n\nboom\n")
+	if response.Status != FilterFail || response.Code != 451 {
+		t.Fatalf("expected %+v for an incomplete message, got %+v", VerdictTempfail, response)
+	}
+	if n := f.ErrorCounts()[queryName(queryDataLine)]; n != 1 {
+		t.Fatalf("expected 1 body failure, got %d", n)
+	}
+}
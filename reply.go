@@ -0,0 +1,131 @@
+package opensmtpd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidReply is returned for a reply smtpd can not send, such as a
+// failure with a 2xx code or text with line breaks.
+var ErrInvalidReply = errors.New("filter: invalid reply")
+
+// EnhancedCode is an RFC 3463 enhanced status code, without its class: that
+// follows from the reply code, 2 for success, 4 for temporary and 5 for
+// permanent failures.
+type EnhancedCode struct {
+	Subject, Detail int
+}
+
+// Enhanced status codes of RFC 3463
+var (
+	EnhancedOther           = EnhancedCode{0, 0} // Other undefined status
+	EnhancedBadMailbox      = EnhancedCode{1, 1} // Bad destination mailbox address
+	EnhancedBadSender       = EnhancedCode{1, 7} // Bad sender's mailbox address syntax
+	EnhancedBadSenderSystem = EnhancedCode{1, 8} // Bad sender's system address
+	EnhancedMailboxFull     = EnhancedCode{2, 2} // Mailbox full
+	EnhancedSystemFull      = EnhancedCode{3, 1} // Mail system full
+	EnhancedNotAccepting    = EnhancedCode{3, 2} // System not accepting network messages
+	EnhancedTooBig          = EnhancedCode{3, 4} // Message too big for system
+	EnhancedCongestion      = EnhancedCode{4, 5} // Mail system congestion
+	EnhancedSyntax          = EnhancedCode{5, 2} // Syntax error
+	EnhancedSecurity        = EnhancedCode{7, 0} // Other or undefined security status
+	EnhancedNotAuthorized   = EnhancedCode{7, 1} // Delivery not authorized, message refused
+)
+
+// Format returns the enhanced status code for an SMTP reply code
+func (c EnhancedCode) Format(code int) string {
+	return fmt.Sprintf("%d.%d.%d", code/100, c.Subject, c.Detail)
+}
+
+func (c EnhancedCode) valid() bool {
+	return c.Subject >= 0 && c.Subject <= 999 && c.Detail >= 0 && c.Detail <= 999
+}
+
+// NewVerdict returns the verdict for an SMTP reply, with the enhanced status
+// code preceding the text. The reply is validated like by Verdict.Validate.
+//
+// Replies are single lines: smtpd prints the reply code, a space and the text
+// of the verdict, so continuation lines ("550-...") can not be expressed, and
+// text with line breaks is rejected rather than joined.
+func NewVerdict(status, code int, enhanced EnhancedCode, text string) (Verdict, error) {
+	if !enhanced.valid() {
+		return Verdict{}, fmt.Errorf("%w: enhanced status code %d.%d out of range", ErrInvalidReply, enhanced.Subject, enhanced.Detail)
+	}
+	if code == 0 {
+		return Verdict{}, fmt.Errorf("%w: enhanced status code without reply code", ErrInvalidReply)
+	}
+
+	line := enhanced.Format(code)
+	if text != "" {
+		line += " " + text
+	}
+	v := Verdict{Status: status, Code: code, Line: line}
+	if err := v.Validate(); err != nil {
+		return Verdict{}, err
+	}
+	return v, nil
+}
+
+// Validate checks that smtpd can send the verdict: FilterOK with a 2xx or
+// 3xx code, FilterFail and FilterClose with a 4xx or 5xx code, or no code for
+// the default reply of smtpd. The text must fit in a line, without CR or LF:
+// smtpd can not send multi-line replies for a filter, see NewVerdict.
+func (v Verdict) Validate() error {
+	var codeOK bool
+	switch v.Status {
+	case FilterOK:
+		codeOK = v.Code == 0 || v.Code >= 200 && v.Code < 400
+	case FilterFail, FilterClose:
+		codeOK = v.Code == 0 || v.Code >= 400 && v.Code < 600
+	default:
+		return fmt.Errorf("%w: unknown status %d", ErrInvalidReply, v.Status)
+	}
+	switch {
+	case !codeOK:
+		return fmt.Errorf("%w: code %d for %s", ErrInvalidReply, v.Code, responseName(v.Status))
+	case v.Code == 0 && v.Line != "":
+		return fmt.Errorf("%w: text without code", ErrInvalidReply)
+	case strings.ContainsAny(v.Line, "\r\n"):
+		return fmt.Errorf("%w: line break in text %q", ErrInvalidReply, v.Line)
+	case len(strconv.Itoa(v.Code))+1+len(v.Line) >= maxLineSize:
+		// smtpd aborts on replies that do not fit its line buffer
+		return fmt.Errorf("%w: text of %d bytes too long", ErrInvalidReply, len(v.Line))
+	}
+	return nil
+}
+
+// Respond answers the query with a verdict, after validating it
+func (s *Session) Respond(v Verdict) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	return s.filter.respond(s, v.Status, v.Code, v.Line)
+}
+
+// Tempfail rejects the query with a temporary failure, 451 and the
+// enhanced status code, followed by text if not empty.
+func (s *Session) Tempfail(enhanced EnhancedCode, text string) error {
+	return s.reply(FilterFail, 451, enhanced, text)
+}
+
+// Permfail rejects the query with a permanent failure, 550 and the
+// enhanced status code, followed by text if not empty.
+func (s *Session) Permfail(enhanced EnhancedCode, text string) error {
+	return s.reply(FilterFail, 550, enhanced, text)
+}
+
+// Disconnect rejects the query and has smtpd close the connection, with 421
+// and the enhanced status code, followed by text if not empty.
+func (s *Session) Disconnect(enhanced EnhancedCode, text string) error {
+	return s.reply(FilterClose, 421, enhanced, text)
+}
+
+func (s *Session) reply(status, code int, enhanced EnhancedCode, text string) error {
+	v, err := NewVerdict(status, code, enhanced, text)
+	if err != nil {
+		return err
+	}
+	return s.filter.respond(s, v.Status, v.Code, v.Line)
+}
@@ -0,0 +1,121 @@
+package opensmtpd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func ExampleSession_Permfail() {
+	filter := &Filter{
+		MAIL: func(session *Session, user, domain string) error {
+			if strings.ToLower(domain) == "example.org" {
+				// 550 5.1.7 Sender rejected
+				return session.Permfail(EnhancedBadSender, "Sender rejected")
+			}
+			return session.Accept()
+		},
+		RCPT: func(session *Session, user, domain string) error {
+			if user == "postmaster" {
+				return session.Accept()
+			}
+			// 451 4.4.5 Try again later
+			return session.Tempfail(EnhancedCongestion, "Try again later")
+		},
+	}
+
+	filter.Serve()
+}
+
+func TestVerdictValidate(t *testing.T) {
+	for _, test := range []struct {
+		verdict Verdict
+		valid   bool
+	}{
+		{VerdictAccept, true},
+		{VerdictTempfail, true},
+		{VerdictClose, true},
+		{Verdict{Status: FilterOK, Code: 250, Line: "2.0.0 Ok"}, true},
+		{Verdict{Status: FilterFail}, true},
+		{Verdict{Status: FilterFail, Code: 554, Line: "5.7.1 Rejected"}, true},
+		{Verdict{Status: FilterClose, Code: 554}, true},
+		{Verdict{Status: FilterOK, Code: 550}, false},
+		{Verdict{Status: FilterFail, Code: 250}, false},
+		{Verdict{Status: FilterClose, Code: 700}, false},
+		{Verdict{Status: 42}, false},
+		{Verdict{Status: FilterFail, Line: "no code"}, false},
+		{Verdict{Status: FilterFail, Code: 550, Line: "one\r\n250 two"}, false},
+		{Verdict{Status: FilterFail, Code: 550, Line: "one\ntwo"}, false},
+		{Verdict{Status: FilterFail, Code: 550, Line: strings.Repeat("x", maxLineSize)}, false},
+	} {
+		err := test.verdict.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%+v: %v", test.verdict, err)
+		} else if !test.valid && !errors.Is(err, ErrInvalidReply) {
+			t.Errorf("%+v: expected %v, got %v", test.verdict, ErrInvalidReply, err)
+		}
+	}
+}
+
+func TestNewVerdict(t *testing.T) {
+	v, err := NewVerdict(FilterFail, 550, EnhancedNotAuthorized, "Message rejected, see https://example.org/policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "5.7.1 Message rejected, see https://example.org/policy"; v.Line != want {
+		t.Fatalf("expected line %q, got %q", want, v.Line)
+	}
+
+	if v, err = NewVerdict(FilterFail, 451, EnhancedCongestion, ""); err != nil || v.Line != "4.4.5" {
+		t.Fatalf("expected line %q, got %q (%v)", "4.4.5", v.Line, err)
+	}
+	for _, bad := range []func() (Verdict, error){
+		func() (Verdict, error) { return NewVerdict(FilterFail, 0, EnhancedOther, "") },
+		func() (Verdict, error) { return NewVerdict(FilterFail, 550, EnhancedCode{1000, 0}, "") },
+		func() (Verdict, error) { return NewVerdict(FilterOK, 550, EnhancedOther, "") },
+		func() (Verdict, error) { return NewVerdict(FilterFail, 550, EnhancedOther, "a\r\n550 b") },
+		func() (Verdict, error) { return NewVerdict(FilterFail, 550, EnhancedOther, "a\r\n550-5.0.0 b") },
+	} {
+		if v, err := bad(); !errors.Is(err, ErrInvalidReply) {
+			t.Errorf("expected %v, got %+v (%v)", ErrInvalidReply, v, err)
+		}
+	}
+}
+
+func TestSessionReply(t *testing.T) {
+	for _, test := range []struct {
+		respond func(*Session) error
+		want    filterResponse
+	}{
+		{
+			func(s *Session) error { return s.Tempfail(EnhancedCongestion, "Try again later") },
+			filterResponse{Status: FilterFail, Code: 451, Line: "4.4.5 Try again later"},
+		},
+		{
+			func(s *Session) error { return s.Permfail(EnhancedBadSender, "") },
+			filterResponse{Status: FilterFail, Code: 550, Line: "5.1.7"},
+		},
+		{
+			func(s *Session) error { return s.Disconnect(EnhancedNotAccepting, "Go away") },
+			filterResponse{Status: FilterClose, Code: 421, Line: "4.3.2 Go away"},
+		},
+		{
+			func(s *Session) error { return s.Reject(FilterOK, 550) },
+			filterResponse{Status: FilterFail, Code: 550},
+		},
+	} {
+		ts := newTestSession(t, &Filter{
+			MAIL: func(s *Session, user, domain string) error {
+				return test.respond(s)
+			},
+		})
+
+		query := ts.query(1, 2, queryMAIL)
+		query.PutTypeMailaddr("joe", "example.org")
+		response := ts.roundTrip(query)
+		test.want.QID, test.want.Type = 2, queryMAIL
+		if response != test.want {
+			t.Errorf("expected %+v, got %+v", test.want, response)
+		}
+	}
+}
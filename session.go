@@ -1,40 +1,410 @@
 package opensmtpd
 
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
+// Session is an SMTP session, as seen by the filter
 type Session struct {
 	ID uint64
 
+	// Started is the time the session was created
+	Started time.Time
+
+	// Connect are the connection details, once the Connect query was
+	// received
+	Connect *ConnectQuery
+
+	// HELO is the name the client gave in HELO or EHLO
+	HELO string
+
+	// Transaction is the current transaction, it is reset once the
+	// transaction is committed or rolled back, and on RSET.
+	Transaction Transaction
+
 	filter *Filter
 	qtype  int
 	qid    uint64
+
+	// datalen is the size of the message, reported back at EOM
+	datalen uint32
+
+	// pipe is the data pipe of the current message, if filtered
+	pipe *dataPipe
+
+	// message is the parsed message, written to the pipe on response
+	message *Message
+
+	// refused is set for sessions beyond Filter.MaxSessions
+	refused bool
+
+	// lastSeen is the time of the last message for the session, protected
+	// by the mutex of the filter
+	lastSeen time.Time
+
+	// addr is the address of a MAIL or RCPT query awaiting its response
+	addr Mailaddr
+
+	// mu protects the response state and values
+	mu sync.Mutex
+
+	// responded is set once the query was answered, expired if that was
+	// with the fallback of the filter
+	responded, expired bool
+	timer              *time.Timer
+
+	// link is the state of the current query passed along a chain of
+	// filters
+	link *link
+
+	// shared is set for the view of the session handed to a filter of a
+	// chain, the session it shares the state of. step and index are the
+	// chain and the filter the view was handed to.
+	shared *Session
+	step   *link
+	index  int
+
+	// ctx is cancelled when the session ends, qctx once the current query
+	// is answered
+	ctx             context.Context
+	cancel, qcancel context.CancelFunc
+	qctx            context.Context
+
+	values map[interface{}]interface{}
+}
+
+// Transaction is the state of a mail transaction, as accepted by the filter
+type Transaction struct {
+	// Sender is the MAIL FROM address
+	Sender Mailaddr
+
+	// Recipients are the accepted RCPT TO addresses, so far
+	Recipients []Mailaddr
+
+	// DataLen is the size of the message as received, known at EOM
+	DataLen uint32
+}
+
+// Mailaddr is a mail address, split at the @
+type Mailaddr = imsg.Mailaddr
+
+// accepted updates the session state for a query the filter accepted
+func (s *Session) accepted() {
+	switch s.qtype {
+	case queryMAIL:
+		s.Transaction.Sender = s.addr
+	case queryRCPT:
+		s.Transaction.Recipients = append(s.Transaction.Recipients, s.addr)
+	}
+}
+
+// Key is a typed key for values stored with a Session, such as a verdict
+// made at connect time that is acted upon later. Keys are compared by
+// identity, so every NewKey call creates a distinct key.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey returns a new key, the name is for debugging only.
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+func (k *Key[T]) String() string {
+	return k.name
+}
+
+// Get returns the value stored for the key in the session
+func (k *Key[T]) Get(s *Session) (v T, ok bool) {
+	s = s.session()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stored, found := s.values[k]; found {
+		v, ok = stored.(T)
+	}
+	return
+}
+
+// Set stores a value for the key in the session, until the session ends
+func (k *Key[T]) Set(s *Session, v T) {
+	s = s.session()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[interface{}]interface{})
+	}
+	s.values[k] = v
+}
+
+// Delete removes the value stored for the key in the session
+func (k *Key[T]) Delete(s *Session) {
+	s = s.session()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, k)
 }
 
 func NewSession(f *Filter, id uint64) *Session {
+	s := &Session{
+		ID:      id,
+		Started: time.Now(),
+		filter:  f,
+	}
+	parent := context.Background()
+	if f != nil && f.ctx != nil {
+		parent = f.ctx
+	}
+	s.ctx, s.cancel = context.WithCancel(parent)
+	return s
+}
+
+// Context returns the context of the query being handled, it is cancelled
+// once the query is answered, when the client disconnects, or when the
+// filter shuts down. Between queries, for example in event callbacks, it is
+// the context of the session.
+func (s *Session) Context() context.Context {
+	s = s.session()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.qctx != nil {
+		return s.qctx
+	}
+	return s.ctx
+}
+
+// view returns the session handed to filter i of chain l. It shares the
+// state of s, but responds for filter i only: the chain moves on when that
+// filter accepts the query.
+func (s *Session) view(l *link, i int) *Session {
 	return &Session{
-		ID:     id,
-		filter: f,
+		ID:          s.ID,
+		Started:     s.Started,
+		Connect:     s.Connect,
+		HELO:        s.HELO,
+		Transaction: s.Transaction,
+		filter:      s.filter,
+		shared:      s,
+		step:        l,
+		index:       i,
+	}
+}
+
+// session returns the session a view shares the state of
+func (s *Session) session() *Session {
+	if s.shared != nil {
+		return s.shared
 	}
+	return s
+}
+
+// startQuery creates the context of a new query, with the session locked
+func (s *Session) startQuery() {
+	s.endQuery()
+	s.link = nil
+	s.qctx, s.qcancel = context.WithCancel(s.ctx)
+}
+
+// endQuery cancels the context of the current query, with the session
+// locked
+func (s *Session) endQuery() {
+	if s.qcancel != nil {
+		s.qcancel()
+		s.qctx, s.qcancel = nil, nil
+	}
+}
+
+// end cancels the contexts of the session
+func (s *Session) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endQuery()
+	s.cancel()
 }
 
 func (s *Session) Accept() error {
 	return s.filter.respond(s, FilterOK, 0, "")
 }
 
+// AcceptCode accepts the query with a reply, see Verdict.Validate
 func (s *Session) AcceptCode(code int, line string) error {
-	return s.filter.respond(s, FilterOK, code, line)
+	return s.Respond(Verdict{Status: FilterOK, Code: code, Line: line})
 }
 
+// Reject rejects the query with a bare reply code.
+//
+// Deprecated: a status of FilterOK is silently taken as FilterFail. Use
+// Tempfail, Permfail or Disconnect, which build complete replies, or Respond,
+// which returns ErrInvalidReply for such a verdict.
 func (s *Session) Reject(status, code int) error {
+	return s.RejectCode(status, code, "")
+}
+
+// RejectCode is like Reject, with the text of the reply.
+//
+// Deprecated: like Reject, a status of FilterOK is taken as FilterFail. Use
+// Respond.
+func (s *Session) RejectCode(status, code int, line string) error {
 	if status == FilterOK {
 		status = FilterFail
 	}
 
-	return s.filter.respond(s, status, code, "")
+	return s.Respond(Verdict{Status: status, Code: code, Line: line})
 }
 
-func (s *Session) RejectCode(status, code int, line string) error {
-	if status == FilterOK {
-		status = FilterFail
+// WriteLine passes a line of the message body on to smtpd, it may only be
+// called from the DataLine callback.
+func (s *Session) WriteLine(line string) error {
+	s = s.session()
+	if s.pipe == nil {
+		return errors.New("filter: no data pipe for session")
+	}
+	if _, err := io.WriteString(s.pipe, line); err != nil {
+		return err
+	}
+	_, err := io.WriteString(s.pipe, "\n")
+	return err
+}
+
+// dataPipe filters a message body. smtpd writes the body it received,
+// dot-unstuffed and without the final ".", to our end of the pipe, and
+// reads what we write to out; closing out ends the message.
+type dataPipe struct {
+	in  *os.File
+	out *bufio.Writer
+	f   *os.File
+
+	// n is the number of bytes written to smtpd
+	n uint32
+
+	// body is the message, if parsed as a whole
+	body bytes.Buffer
+
+	// err is the first error of the filter or the pipe
+	err error
+
+	// done is closed once the body was filtered
+	done chan struct{}
+}
+
+func newDataPipe(in, out *os.File) *dataPipe {
+	return &dataPipe{
+		in:   in,
+		out:  bufio.NewWriterSize(out, maxLineSize),
+		f:    out,
+		done: make(chan struct{}),
 	}
+}
 
-	return s.filter.respond(s, status, code, line)
+func (p *dataPipe) Write(b []byte) (int, error) {
+	n, err := p.out.Write(b)
+	p.n += uint32(n)
+	return n, err
+}
+
+// run feeds the body read from in to the DataLine or Body callback.
+func (p *dataPipe) run(s *Session) {
+	defer close(p.done)
+
+	in := p.in
+
+	f := s.filter
+	if f.Message != nil {
+		_, p.err = p.body.ReadFrom(in)
+	} else if f.Body != nil {
+		p.err = f.protect(s, queryName(queryDataLine), func() error { return f.Body(s, in, p) })
+	} else {
+		r := bufio.NewReaderSize(in, maxLineSize)
+		for {
+			line, err := r.ReadString('\n')
+			if len(line) > 0 {
+				line = strings.TrimSuffix(line, "\n")
+				if p.err = f.protect(s, queryName(queryDataLine), func() error { return f.DataLine(s, line) }); p.err != nil {
+					break
+				}
+			}
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				p.err = err
+				break
+			}
+		}
+	}
+
+	// smtpd must not block on a filter that stopped reading early
+	io.Copy(io.Discard, in)
+	in.Close()
+
+	if f.Message == nil {
+		p.close()
+	}
+}
+
+// close ends the message
+func (p *dataPipe) close() error {
+	if err := p.out.Flush(); err != nil && p.err == nil {
+		p.err = err
+	}
+	if err := p.f.Close(); err != nil && p.err == nil {
+		p.err = err
+	}
+	return p.err
+}
+
+// abort ends the pipe of a message smtpd gave up on. The body is no longer
+// read, and our end of the pipe to smtpd is closed once the callbacks are
+// done with it.
+func (p *dataPipe) abort(message bool) {
+	p.in.Close()
+	if message {
+		// Only run closes the pipe of DataLine and Body callbacks
+		go func() {
+			<-p.done
+			p.close()
+		}()
+	}
+}
+
+// dropPipe aborts the data pipe of the session, for a message that was not
+// answered. It is called from the goroutine handling the session.
+func (s *Session) dropPipe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pipe != nil {
+		s.pipe.abort(s.filter.Message != nil)
+	}
+	s.pipe, s.message = nil, nil
+}
+
+// writeMessage passes the parsed message on to smtpd, with the changes of
+// the filter. If the query expired, the Message callback may still be
+// changing the message: smtpd then gets the message as received.
+func (s *Session) writeMessage() error {
+	p, m := s.pipe, s.message
+	s.pipe, s.message = nil, nil
+
+	var err error
+	if s.expired {
+		_, err = p.Write(p.body.Bytes())
+	} else {
+		_, err = m.WriteTo(p)
+	}
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	if err := p.close(); err != nil {
+		return err
+	}
+	s.datalen = p.n
+	return nil
 }
@@ -0,0 +1,230 @@
+package opensmtpd
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
+func TestSessionTransaction(t *testing.T) {
+	var committed Transaction
+	f := &Filter{
+		Connect: func(session *Session, query *ConnectQuery) error {
+			return session.Accept()
+		},
+		RCPT: func(session *Session, user, domain string) error {
+			if user == "spam" {
+				return session.Reject(FilterFail, 550)
+			}
+			return session.Accept()
+		},
+		Commit: func(session *Session) error {
+			committed = session.Transaction
+			return nil
+		},
+	}
+	ts := newTestSession(t, f)
+
+	ts.event(1, eventConnect)
+	m := ts.query(1, 2, queryConnect)
+	m.PutTypeSockaddr(mustSockaddr(t, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}))
+	m.PutTypeSockaddr(mustSockaddr(t, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4321}))
+	m.PutTypeString("mx.example.org")
+	ts.roundTrip(m)
+	m = ts.query(1, 2, queryHELO)
+	m.PutTypeString("helo.example.org")
+	ts.roundTrip(m)
+	ts.event(1, eventTXBegin)
+	m = ts.query(1, 2, queryMAIL)
+	m.PutTypeMailaddr("joe", "example.org")
+	ts.roundTrip(m)
+	for _, user := range []string{"alice", "spam", "bob"} {
+		m = ts.query(1, 2, queryRCPT)
+		m.PutTypeMailaddr(user, "example.com")
+		ts.roundTrip(m)
+	}
+	m = ts.query(1, 2, queryEOM)
+	m.PutTypeUint32(1234)
+	ts.handle(m)
+	ts.reply(nil)
+	ts.event(1, eventTXCommit)
+
+	s := f.getSession(1)
+	if s.Connect == nil || s.Connect.Hostname != "mx.example.org" || s.Connect.Remote.String() != "192.0.2.1:4321" {
+		t.Fatalf("unexpected connect query %+v", s.Connect)
+	}
+	if s.HELO != "helo.example.org" {
+		t.Fatalf("unexpected HELO %q", s.HELO)
+	}
+	want := Transaction{
+		Sender: Mailaddr{User: "joe", Domain: "example.org"},
+		Recipients: []Mailaddr{
+			{User: "alice", Domain: "example.com"},
+			{User: "bob", Domain: "example.com"},
+		},
+		DataLen: 1234,
+	}
+	if !reflect.DeepEqual(committed, want) {
+		t.Fatalf("expected transaction %+v, got %+v", want, committed)
+	}
+	if !reflect.DeepEqual(s.Transaction, Transaction{}) {
+		t.Fatalf("transaction not reset after commit: %+v", s.Transaction)
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	var (
+		s       = NewSession(nil, 1)
+		verdict = NewKey[string]("verdict")
+		other   = NewKey[string]("verdict")
+	)
+	if _, ok := verdict.Get(s); ok {
+		t.Fatal("unexpected value for unset key")
+	}
+	verdict.Set(s, "listed")
+	if v, ok := verdict.Get(s); !ok || v != "listed" {
+		t.Fatalf("expected %q, got %q", "listed", v)
+	}
+	if _, ok := other.Get(s); ok {
+		t.Fatal("keys with the same name are not distinct")
+	}
+	verdict.Delete(s)
+	if _, ok := verdict.Get(s); ok {
+		t.Fatal("value not deleted")
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	var (
+		contexts  = make(chan context.Context, 2)
+		cancelled = make(chan struct{})
+	)
+	f := &Filter{
+		Connected: func(session *Session) error {
+			contexts <- session.Context()
+			return nil
+		},
+		HELO: func(session *Session, helo string) error {
+			contexts <- session.Context()
+			return session.Accept()
+		},
+		MAIL: func(session *Session, user, domain string) error {
+			// A slow lookup, given up when the client disconnects
+			<-session.Context().Done()
+			close(cancelled)
+			return nil
+		},
+		ready: true,
+	}
+	ts := newTestSession(t, f)
+
+	done := make(chan error)
+	go func() { done <- f.Serve() }()
+
+	m := imsg.NewMessage(typeFilterEvent)
+	m.PutTypeID(1)
+	m.PutTypeInt(eventConnect)
+	ts.write(m)
+	m = ts.query(1, 2, queryHELO)
+	m.PutTypeString("mx.example.org")
+	ts.write(m)
+	ts.reply(nil)
+
+	sessionCtx, queryCtx := <-contexts, <-contexts
+	if queryCtx == sessionCtx {
+		t.Fatal("expected a query context")
+	}
+	if queryCtx.Err() == nil {
+		t.Fatal("query context not cancelled on response")
+	}
+	if sessionCtx.Err() != nil {
+		t.Fatal("session context cancelled before disconnect")
+	}
+
+	// The disconnect is queued behind the MAIL query
+	m = ts.query(1, 3, queryMAIL)
+	m.PutTypeMailaddr("joe", "example.org")
+	ts.write(m)
+	m = imsg.NewMessage(typeFilterEvent)
+	m.PutTypeID(1)
+	m.PutTypeInt(eventDisconnect)
+	ts.write(m)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("query context not cancelled on disconnect")
+	}
+	if sessionCtx.Err() == nil {
+		t.Fatal("session context not cancelled on disconnect")
+	}
+
+	ts.smtpd.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSockaddr(t *testing.T, addr net.Addr) imsg.Sockaddr {
+	t.Helper()
+	sa, err := imsg.NewSockaddr(addr, imsg.NativeLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sa
+}
+
+func TestFilterSessions(t *testing.T) {
+	var called int
+	f := &Filter{
+		Connected: func(session *Session) error {
+			called++
+			return nil
+		},
+		HELO: func(session *Session, helo string) error {
+			called++
+			return session.Accept()
+		},
+		MaxSessions:    1,
+		SessionTimeout: time.Minute,
+	}
+	ts := newTestSession(t, f)
+
+	for id := uint64(1); id <= 2; id++ {
+		ts.event(id, eventConnect)
+	}
+
+	m := ts.query(2, 20, queryHELO)
+	m.PutTypeString("mx.example.org")
+	if response := ts.roundTrip(m); response.Status != VerdictTempfail.Status || response.Code != VerdictTempfail.Code {
+		t.Fatalf("expected refused session to be answered %+v, got %+v", VerdictTempfail, response)
+	}
+	if called != 1 {
+		t.Fatalf("expected 1 callback, got %d", called)
+	}
+
+	sessions := f.Sessions()
+	if len(sessions) != 2 || sessions[0].ID != 1 || sessions[1].ID != 2 {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	f.dropLeaked(time.Now().Add(30 * time.Second))
+	if len(f.Sessions()) != 2 {
+		t.Fatal("active sessions dropped")
+	}
+	f.dropLeaked(time.Now().Add(2 * time.Minute))
+	if len(f.Sessions()) != 0 {
+		t.Fatal("leaked sessions not dropped")
+	}
+}
+
+func TestFilterSweepShortTimeout(t *testing.T) {
+	f := &Filter{SessionTimeout: time.Nanosecond}
+	stop := make(chan struct{})
+	close(stop)
+	f.sweep(stop)
+}
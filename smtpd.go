@@ -2,12 +2,14 @@ package opensmtpd
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
 )
 
 const (
-	// FilterVersion is the supported filter API version
+	// FilterVersion is the most recent supported filter API version, see
+	// FilterVersions for all of them
 	FilterVersion = 52
 
 	// QueueVersion is the supported queue API version
@@ -18,9 +20,18 @@ const (
 )
 
 var (
-	// Debug flag
+	// Debug logs at debug level to stderr, for filters and tables without
+	// Logger.
+	//
+	// Deprecated: set Filter.Logger or Table.Logger to a logger with the
+	// level of choice.
 	Debug bool
 
+	// Capture receives a copy of every imsg frame exchanged with smtpd, if
+	// set before calling Serve. The capture can be replayed with
+	// cmd/imsg-replay.
+	Capture io.Writer
+
 	prog = os.Args[0]
 )
 
@@ -65,15 +76,6 @@ func serviceName(service int) string {
 	return strings.Join(s, ",")
 }
 
-func debugf(format string, v ...interface{}) {
-	if !Debug {
-		return
-	}
-
-	line := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
-	fmt.Fprintln(os.Stderr, prog+": debug: "+line)
-}
-
 func fatal(v ...interface{}) {
 	line := strings.TrimSuffix(fmt.Sprint(v...), "\n")
 	fmt.Fprintln(os.Stderr, prog+": "+line)
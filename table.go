@@ -1,42 +1,28 @@
 package opensmtpd
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"fmt"
 	"io"
-	"log"
-	"net"
-	"os"
+	"log/slog"
+	"time"
+
+	"gopkg.in/opensmtpd.v0/imsg"
 )
 
 const (
-	procTableOK = iota
-	procTableFail
-	procTableOpen
-	procTableClose
-	procTableUpdate
-	procTableCheck
-	procTableLookup
-	procTableFetch
+	procTableOK     = imsg.TableOK
+	procTableFail   = imsg.TableFail
+	procTableOpen   = imsg.TableOpen
+	procTableClose  = imsg.TableClose
+	procTableUpdate = imsg.TableUpdate
+	procTableCheck  = imsg.TableCheck
+	procTableLookup = imsg.TableLookup
+	procTableFetch  = imsg.TableFetch
 )
 
-var procTableTypeName = map[uint32]string{
-	procTableOK:     "PROC_TABLE_OK",
-	procTableFail:   "PROC_TABLE_FAIL",
-	procTableOpen:   "PROC_TABLE_OPEN",
-	procTableClose:  "PROC_TABLE_CLOSE",
-	procTableUpdate: "PROC_TABLE_UPDATE",
-	procTableCheck:  "PROC_TABLE_CHECK",
-	procTableLookup: "PROC_TABLE_LOOKUP",
-	procTableFetch:  "PROC_TABLE_FETCH",
-}
-
 func procTableName(t uint32) string {
-	if s, ok := procTableTypeName[t]; ok {
-		return s
-	}
-	return fmt.Sprintf("UNKNOWN %d", t)
+	return imsg.TableTypeName(t)
 }
 
 // Table implements the OpenSMTPD table API
@@ -47,36 +33,57 @@ type Table struct {
 	// Check callback
 	Check func(service int, params Dict, key string) (int, error)
 
-	// Lookup callback
+	// Lookup callback, results that do not fit in one imsg (see
+	// imsg.MaxSize) are answered as temporary failure
 	Lookup func(service int, params Dict, key string) (string, error)
 
-	// Fetch callback
+	// Fetch callback, with the same size limit as Lookup
 	Fetch func(service int, params Dict) (string, error)
 
 	// Close callback, called at stop
 	Close func() error
 
-	c      net.Conn
-	m      *message
+	// Logger receives the log messages of the table, the default logger of
+	// the slog package if nil.
+	Logger Logger
+
+	c      *conn
+	m      *imsg.Message
 	closed bool
 }
 
 func (t *Table) Serve() error {
+	return t.ServeContext(context.Background())
+}
+
+// ServeContext is like Serve, it also stops once ctx is done. The query
+// being handled is answered first, then ctx.Err() is returned.
+func (t *Table) ServeContext(ctx context.Context) error {
 	var err error
 
 	if t.c, err = newConn(0); err != nil {
 		return err
 	}
+	t.c.logger = t.Logger
+
+	t.m = new(imsg.Message)
 
-	t.m = new(message)
+	// Interrupt the pending read on shutdown
+	stop := context.AfterFunc(ctx, func() { t.c.SetReadDeadline(time.Now()) })
+	defer stop()
 
 	for !t.closed {
-		if err = t.m.ReadFrom(t.c); err != nil {
-			if err.Error() != "resource temporarily unavailable" {
-				return fmt.Errorf("read error: %v", err)
-			}
+		if err = t.c.ReadMessage(t.m); err == io.EOF {
+			return nil
+		} else if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			return fmt.Errorf("read error: %v", err)
+		}
+		if l := logAt(t.Logger, slog.LevelDebug); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelDebug, "table imsg",
+				slog.String("type", procTableName(t.m.Header.Type)))
 		}
-		debugf("table: %s", procTableName(t.m.Header.Type))
 		if err = t.dispatch(); err != nil {
 			return fmt.Errorf("dispatch error: %v", err)
 		}
@@ -85,48 +92,54 @@ func (t *Table) Serve() error {
 	return err
 }
 
+// tableOpenParams are the PROC_TABLE_OPEN arguments
 type tableOpenParams struct {
-	Version uint32
-	Name    [maxLineSize]byte
+	Version uint32 `mproc:"uint32"`
+	Name    string `mproc:"string"`
+}
+
+// tableQuery are the PROC_TABLE_CHECK and PROC_TABLE_LOOKUP arguments
+type tableQuery struct {
+	Service int    `mproc:"int"`
+	Params  Dict   `mproc:"params"`
+	Key     string `mproc:"string"`
+}
+
+// tableFetchQuery are the PROC_TABLE_FETCH arguments
+type tableFetchQuery struct {
+	Service int  `mproc:"int"`
+	Params  Dict `mproc:"params"`
+}
+
+// tableResult is the PROC_TABLE_OK reply
+type tableResult struct {
+	Result int    `mproc:"int"`
+	Value  string `mproc:"string,omitempty"`
 }
 
 func (t *Table) dispatch() (err error) {
 	switch t.m.Header.Type {
 	case procTableOpen:
-		/*
-			var op tableOpenParams
-			if err = t.getMessage(&op, maxLineSize+4); err != nil {
-				return
-			}
-
-			if op.Version != TableVersion {
-				fatalf("table: bad API version %d (we support %d)", op.Version, TableVersion)
-			}
-			if bytes.IndexByte(op.Name[:], 0) <= 0 {
-				fatal("table: no name supplied")
-			}
-		*/
-		var version uint32
-		if version, err = t.m.GetUint32(); err != nil {
+		var op tableOpenParams
+		if err = imsg.UnmarshalUntyped(t.m, &op); err != nil {
 			return
-		} else if version != TableVersion {
-			fatalf("table: expected API version %d, got %d", TableVersion, version)
 		}
-
-		var name string
-		if name, err = t.m.GetString(); err != nil {
-			return
-		} else if name == "" {
+		if op.Version != TableVersion {
+			fatalf("table: expected API version %d, got %d", TableVersion, op.Version)
+		}
+		if op.Name == "" {
 			fatal("table: no name supplied by smtpd!?")
 		}
 
-		debugf("table: version=%d name=%q\n", version, name)
+		if l := logAt(t.Logger, slog.LevelInfo); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelInfo, "table opened",
+				slog.String("name", op.Name),
+				slog.Uint64("version", uint64(op.Version)))
+		}
 
-		m := new(message)
-		m.Header.Type = procTableOK
-		m.Header.Len = imsgHeaderSize
-		m.Header.PID = uint32(os.Getpid())
-		if err = m.WriteTo(t.c); err != nil {
+		m := imsg.AcquireMessage(procTableOK)
+		defer imsg.ReleaseMessage(m)
+		if err = t.c.WriteMessage(m); err != nil {
 			return
 		}
 
@@ -139,10 +152,12 @@ func (t *Table) dispatch() (err error) {
 			}
 		}
 
-		m := new(message)
-		m.Header.Type = procTableOK
-		m.PutInt(r)
-		if err = m.WriteTo(t.c); err != nil {
+		m := imsg.AcquireMessage(procTableOK)
+		defer imsg.ReleaseMessage(m)
+		if err = imsg.MarshalUntyped(m, &tableResult{Result: r}); err != nil {
+			return
+		}
+		if err = t.c.WriteMessage(m); err != nil {
 			return
 		}
 
@@ -157,23 +172,13 @@ func (t *Table) dispatch() (err error) {
 		return
 
 	case procTableCheck:
-		var service int
-		if service, err = t.m.GetInt(); err != nil {
-			return
-		}
-
-		var params Dict
-		if params, err = t.getParams(); err != nil {
+		var query tableQuery
+		if err = imsg.UnmarshalUntyped(t.m, &query); err != nil {
 			return
 		}
+		service, params, key := query.Service, query.Params, query.Key
 
-		var key string
-		if key, err = t.m.GetString(); err != nil {
-			return
-		}
-
-		debugf("table_check: service=%s,params=%+v,key=%q",
-			serviceName(service), params, key)
+		t.logQuery("table check", service, params, slog.String("key", key))
 
 		var r = -1
 		if t.Check != nil {
@@ -182,34 +187,28 @@ func (t *Table) dispatch() (err error) {
 			}
 		}
 
-		log.Printf("table_check: result=%d\n", r)
-
-		m := new(message)
-		m.Header.Type = procTableOK
-		m.Header.PID = uint32(os.Getpid())
-		m.PutInt(r)
-		if err = m.WriteTo(t.c); err != nil {
-			return
+		if l := logAt(t.Logger, slog.LevelDebug); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelDebug, "table check result",
+				slog.Int("result", r))
 		}
 
-	case procTableLookup:
-		var service int
-		if service, err = t.m.GetInt(); err != nil {
+		m := imsg.AcquireMessage(procTableOK)
+		defer imsg.ReleaseMessage(m)
+		if err = imsg.MarshalUntyped(m, &tableResult{Result: r}); err != nil {
 			return
 		}
-
-		var params Dict
-		if params, err = t.getParams(); err != nil {
+		if err = t.c.WriteMessage(m); err != nil {
 			return
 		}
 
-		var key string
-		if key, err = t.m.GetString(); err != nil {
+	case procTableLookup:
+		var query tableQuery
+		if err = imsg.UnmarshalUntyped(t.m, &query); err != nil {
 			return
 		}
+		service, params, key := query.Service, query.Params, query.Key
 
-		debugf("table_lookup: service=%s,params=%+v,key=%q",
-			serviceName(service), params, key)
+		t.logQuery("table lookup", service, params, slog.String("key", key))
 
 		var val string
 		if t.Lookup != nil {
@@ -218,32 +217,18 @@ func (t *Table) dispatch() (err error) {
 			}
 		}
 
-		m := new(message)
-		m.Header.Type = procTableOK
-		m.Header.PID = uint32(os.Getpid())
-		if val == "" {
-			m.PutInt(-1)
-		} else {
-			m.PutInt(1)
-			m.PutString(val)
-		}
-		if err = m.WriteTo(t.c); err != nil {
+		if err = t.writeValue(val); err != nil {
 			return
 		}
 
 	case procTableFetch:
-		var service int
-		if service, err = t.m.GetInt(); err != nil {
-			return
-		}
-
-		var params Dict
-		if params, err = t.getParams(); err != nil {
+		var query tableFetchQuery
+		if err = imsg.UnmarshalUntyped(t.m, &query); err != nil {
 			return
 		}
+		service, params := query.Service, query.Params
 
-		debugf("table_fetch: service=%s,params=%+v",
-			serviceName(service), params)
+		t.logQuery("table fetch", service, params)
 
 		var val string
 		if t.Fetch != nil {
@@ -252,16 +237,7 @@ func (t *Table) dispatch() (err error) {
 			}
 		}
 
-		m := new(message)
-		m.Header.Type = procTableOK
-		m.Header.PID = uint32(os.Getpid())
-		if val == "" {
-			m.PutInt(-1)
-		} else {
-			m.PutInt(1)
-			m.PutString(val)
-		}
-		if err = m.WriteTo(t.c); err != nil {
+		if err = t.writeValue(val); err != nil {
 			return
 		}
 
@@ -270,36 +246,85 @@ func (t *Table) dispatch() (err error) {
 	return nil
 }
 
-func (t *Table) getMessage(data interface{}, size int) (err error) {
-	buf := make([]byte, size)
-	if _, err = io.ReadFull(t.c, buf); err != nil {
-		return
+// logQuery logs a check, lookup or fetch query
+func (t *Table) logQuery(msg string, service int, params Dict, attrs ...slog.Attr) {
+	if l := logAt(t.Logger, slog.LevelDebug); l != nil {
+		l.LogAttrs(context.Background(), slog.LevelDebug, msg, append([]slog.Attr{
+			slog.String("service", serviceName(service)),
+			slog.Any("params", params),
+		}, attrs...)...)
+	}
+}
+
+// writeValue answers a lookup or fetch. A value too large to fit in one imsg
+// can not be sent to smtpd, it is answered as a temporary failure instead.
+func (t *Table) writeValue(val string) error {
+	result := tableResult{Result: -1}
+	if val != "" {
+		result = tableResult{Result: 1, Value: val}
+	}
+
+	m := imsg.AcquireMessage(procTableOK)
+	defer imsg.ReleaseMessage(m)
+	if err := imsg.MarshalUntyped(m, &result); err != nil {
+		return err
+	}
+	if m.Len() > imsg.MaxSize {
+		if l := logAt(t.Logger, slog.LevelWarn); l != nil {
+			l.LogAttrs(context.Background(), slog.LevelWarn, "table value exceeds the imsg size limit",
+				slog.Int("size", len(val)))
+		}
+		m.Reset()
+		m.Header.Type = procTableOK
+		if err := imsg.MarshalUntyped(m, &tableResult{Result: -1}); err != nil {
+			return err
+		}
 	}
+	return t.c.WriteMessage(m)
+}
 
-	return binary.Read(bytes.NewBuffer(buf), binary.LittleEndian, data)
+// MarshalMproc encodes the table parameters, as the size followed by the
+// key/value pairs.
+func (params Dict) MarshalMproc(m *imsg.Message, typed bool) error {
+	if typed {
+		m.PutTypeSize(uint64(len(params)))
+	} else {
+		m.PutSize(uint64(len(params)))
+	}
+	for k, v := range params {
+		m.PutString(k)
+		m.PutString(fmt.Sprint(v))
+	}
+	return nil
 }
 
-func (t *Table) getParams() (params Dict, err error) {
+// UnmarshalMproc decodes the table parameters, as the size followed by the
+// key/value pairs.
+func (params *Dict) UnmarshalMproc(m *imsg.Message, typed bool) (err error) {
 	var count uint64
-	if count, err = t.m.GetSize(); err != nil {
+	if typed {
+		count, err = m.GetTypeSize()
+	} else {
+		count, err = m.GetSize()
+	}
+	if err != nil {
 		return
 	}
-	debugf("params: %d pairs", count)
 
-	params = make(Dict, count)
+	*params = make(Dict, count)
 	if count == 0 {
 		return
 	}
 
 	var k, v string
 	for ; count != 0; count-- {
-		if k, err = t.m.GetString(); err != nil {
+		if k, err = m.GetString(); err != nil {
 			return
 		}
-		if v, err = t.m.GetString(); err != nil {
+		if v, err = m.GetString(); err != nil {
 			return
 		}
-		params[k] = v
+		(*params)[k] = v
 	}
 
 	return
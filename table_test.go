@@ -1,5 +1,11 @@
 package opensmtpd
 
+import (
+	"testing"
+
+	"gopkg.in/opensmtpd.v0/imsg"
+)
+
 func ExampleTable() {
 	// In smtpd.conf:
 	//
@@ -21,3 +27,40 @@ func ExampleTable() {
 	}
 	table.Serve()
 }
+
+func BenchmarkTableLookup(b *testing.B) {
+	c, smtpd := testConnPair(b)
+	t := &Table{
+		Lookup: func(service int, params Dict, key string) (string, error) {
+			return "user@example.org", nil
+		},
+		Logger: testDiscard,
+		c:      c,
+		m:      new(imsg.Message),
+	}
+
+	var (
+		query = imsg.NewMessage(procTableLookup)
+		reply = new(imsg.Message)
+	)
+	query.PutInt(ServiceAlias)
+	query.PutSize(0)
+	query.PutString("root")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := smtpd.WriteMessage(query); err != nil {
+			b.Fatal(err)
+		}
+		if err := t.c.ReadMessage(t.m); err != nil {
+			b.Fatal(err)
+		}
+		if err := t.dispatch(); err != nil {
+			b.Fatal(err)
+		}
+		if err := smtpd.ReadMessage(reply); err != nil {
+			b.Fatal(err)
+		}
+	}
+}